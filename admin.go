@@ -0,0 +1,103 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"gopkg.in/mgo.v2"
+	"log"
+	"net/http"
+)
+
+// Wrap an admin handler so it requires "Authorization: Bearer <token>".
+func requireAdminToken(token string, handler http.HandlerFunc) http.HandlerFunc {
+	expected := []byte("Bearer " + token)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), expected) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+
+		handler(w, r)
+	}
+}
+
+func writeJson(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Println(err)
+	}
+}
+
+func writeJsonError(w http.ResponseWriter, status int, message string) {
+	writeJson(w, status, map[string]string{"error": message})
+}
+
+// The site an admin request is for: the site parameter, which can be left
+// out when there is only one.  Returns the status to respond with on error.
+func adminSite(sites *siteRouter, r *http.Request) (*site, int, error) {
+	siteId := r.FormValue("site")
+
+	if len(siteId) == 0 {
+		if len(sites.Sites()) == 1 {
+			return sites.Sites()[0], http.StatusOK, nil
+		}
+		return nil, http.StatusBadRequest, errors.New("missing site")
+	}
+
+	s, ok := sites.Get(siteId)
+
+	if !ok {
+		return nil, http.StatusNotFound, errors.New("unknown site: " + siteId)
+	}
+
+	return s, http.StatusOK, nil
+}
+
+// GET /v1/usage?site=<id>&period=<day|month>
+// Both parameters are optional; all sites and periods are returned by default.
+func handleUsageRequest(session *mgo.Session, sites *siteRouter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			writeJsonError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+
+		period := r.FormValue("period")
+		if len(period) > 0 && period != usagePeriodDay && period != usagePeriodMonth {
+			writeJsonError(w, http.StatusBadRequest, "invalid period: "+period)
+			return
+		}
+
+		selected := sites.Sites()
+
+		if siteId := r.FormValue("site"); len(siteId) > 0 {
+			s, ok := sites.Get(siteId)
+			if !ok {
+				writeJsonError(w, http.StatusNotFound, "unknown site: "+siteId)
+				return
+			}
+			selected = []*site{s}
+		}
+
+		usages := []usage{}
+
+		for _, s := range selected {
+			siteUsages, err := GetSiteUsage(session, s, period)
+
+			if err != nil {
+				log.Println(err)
+				writeJsonError(w, http.StatusInternalServerError, "could not read usage")
+				return
+			}
+
+			usages = append(usages, siteUsages...)
+		}
+
+		writeJson(w, http.StatusOK, usages)
+	}
+}
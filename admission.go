@@ -0,0 +1,139 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// How long the decision on a request is kept for the rest of its parts, and
+// how long a request missing parts waits for them.
+const requestExpirySeconds = 60
+
+// What happens to every part of a request.  A status other than 0 is sent in
+// place of the pixel; dropped parts are sent the pixel but discarded.
+type admission struct {
+	site       *site
+	status     int
+	drop       bool
+	quarantine string
+	total      int
+	parts      map[int]bool
+	created    time.Time
+}
+
+// Decides whether to accept a request, and for which site, once: for the
+// first of its parts to arrive.  The other parts get the same decision, so a
+// split request is never routed to two sites or accepted only in part.
+type requestAdmitter struct {
+	sites     *siteRouter
+	limiter   *requestLimiter
+	maxParts  int
+	decisions map[string]*admission
+	mutex     sync.Mutex
+}
+
+func newRequestAdmitter(sites *siteRouter, limiter *requestLimiter, maxParts int) *requestAdmitter {
+	return &requestAdmitter{
+		sites:     sites,
+		limiter:   limiter,
+		maxParts:  maxParts,
+		decisions: make(map[string]*admission),
+	}
+}
+
+// The decision for part of total of request id, made from this part if it
+// is the first.  Parts over maxParts, parts sent twice and parts that
+// disagree on the total are refused on their own.
+func (a *requestAdmitter) Admit(r *http.Request, id string, part int, total int, params map[string]string) *admission {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if total > a.maxParts {
+		return &admission{status: http.StatusBadRequest}
+	}
+
+	if d, ok := a.decisions[id]; ok {
+		if total != d.total || d.parts[part] {
+			return &admission{status: http.StatusBadRequest}
+		}
+
+		d.parts[part] = true
+
+		// Every part takes a token, so a request ID can't be reused to send
+		// parts past the limits.  Once one is throttled, so is the rest of
+		// the request.
+		if d.status == 0 && !d.drop && !a.limiter.Allow(r, params[paramBeamId]) {
+			a.throttle(d)
+		}
+
+		return d
+	}
+
+	d := &admission{
+		total:   total,
+		parts:   map[int]bool{part: true},
+		created: time.Now(),
+	}
+	a.decisions[id] = d
+
+	// Only one part of a split request carries the beam, so it is only
+	// limited if that part arrives first.
+	if !a.limiter.Allow(r, params[paramBeamId]) {
+		a.throttle(d)
+		return d
+	}
+
+	s, ok := a.sites.Route(r, params)
+
+	if !ok {
+		d.status = http.StatusForbidden
+		return d
+	}
+
+	d.site = s
+
+	// Sampling hashes the request ID, but deciding here also keeps every part
+	// of a rejected request together.
+	if params[paramsTypeKey] == "particle" {
+		switch s.usage.Check(s.quota, id) {
+		case quotaReject:
+			d.status = http.StatusTooManyRequests
+			return d
+		case quotaSample:
+			d.drop = true
+			return d
+		}
+
+		if reason := s.domains.CheckOrigin(r); len(reason) > 0 {
+			if s.domains.action == domainActionReject {
+				d.status = http.StatusForbidden
+			} else {
+				d.quarantine = reason
+			}
+		}
+	}
+
+	return d
+}
+
+func (a *requestAdmitter) throttle(d *admission) {
+	if a.limiter.response == rateLimitResponseReject {
+		d.status = http.StatusTooManyRequests
+	} else {
+		d.drop = true
+	}
+}
+
+// Forget decisions made more than requestExpirySeconds ago; every part of
+// their requests has arrived by now, or never will.
+func (a *requestAdmitter) Sweep(now time.Time) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	for id, d := range a.decisions {
+		if now.Sub(d.created) > requestExpirySeconds*time.Second {
+			delete(a.decisions, id)
+		}
+	}
+}
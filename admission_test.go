@@ -0,0 +1,96 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func testRequestAdmitter(ipBurst int) *requestAdmitter {
+	s := &site{Id: "shop"}
+
+	sites := &siteRouter{
+		sites: []*site{s},
+		byId:  map[string]*site{s.Id: s},
+		byKey: map[string]*site{},
+	}
+
+	limiter := loadRequestLimiter(RateLimitConfig{IpRate: 0.001, IpBurst: ipBurst, Response: rateLimitResponseReject})
+
+	return newRequestAdmitter(sites, limiter, 10)
+}
+
+func TestRequestAdmitterParts(t *testing.T) {
+	tests := []struct {
+		name   string
+		parts  [][2]int
+		status []int
+	}{
+		{"every part", [][2]int{{1, 3}, {2, 3}, {3, 3}}, []int{0, 0, 0}},
+		{"duplicate part", [][2]int{{1, 3}, {2, 3}, {2, 3}}, []int{0, 0, http.StatusBadRequest}},
+		{"duplicate first part", [][2]int{{1, 2}, {1, 2}}, []int{0, http.StatusBadRequest}},
+		{"different total", [][2]int{{1, 2}, {2, 3}}, []int{0, http.StatusBadRequest}},
+	}
+
+	for _, test := range tests {
+		a := testRequestAdmitter(10)
+
+		for i, part := range test.parts {
+			r := httptest.NewRequest("GET", "/beam", nil)
+
+			d := a.Admit(r, "abc", part[0], part[1], map[string]string{paramsTypeKey: "beam"})
+
+			if d.status != test.status[i] {
+				t.Errorf("%s: part %d-%d status = %d, want %d", test.name, part[0], part[1], d.status, test.status[i])
+			}
+		}
+	}
+}
+
+func TestRequestAdmitterLimitsEveryPart(t *testing.T) {
+	a := testRequestAdmitter(2)
+
+	var statuses []int
+
+	for part := 1; part <= 3; part++ {
+		r := httptest.NewRequest("GET", "/beam", nil)
+
+		statuses = append(statuses, a.Admit(r, "abc", part, 3, map[string]string{paramsTypeKey: "beam"}).status)
+	}
+
+	// The third part is over the burst, and the decision sticks for any later
+	// part of the request.
+	if statuses[0] != 0 || statuses[1] != 0 || statuses[2] != http.StatusTooManyRequests {
+		t.Errorf("statuses = %v, want [0 0 429]", statuses)
+	}
+
+	if d := a.decisions["abc"]; d.status != http.StatusTooManyRequests {
+		t.Errorf("request status = %d, want 429", d.status)
+	}
+}
+
+func TestRequestAdmitterMaxParts(t *testing.T) {
+	tests := []struct {
+		part   int
+		total  int
+		status int
+	}{
+		{1, 10, 0},
+		{1, 11, http.StatusBadRequest},
+		{1, 2000000000, http.StatusBadRequest},
+	}
+
+	for _, test := range tests {
+		a := testRequestAdmitter(10)
+		r := httptest.NewRequest("GET", "/beam", nil)
+
+		if d := a.Admit(r, "abc", test.part, test.total, map[string]string{paramsTypeKey: "beam"}); d.status != test.status {
+			t.Errorf("part %d-%d status = %d, want %d", test.part, test.total, d.status, test.status)
+		}
+
+		// Refused parts never start a request.
+		if _, ok := a.decisions["abc"]; ok != (test.status == 0) {
+			t.Errorf("part %d-%d recorded = %v", test.part, test.total, ok)
+		}
+	}
+}
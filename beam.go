@@ -5,26 +5,38 @@ import (
 	"gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
 	"log"
+	"strings"
 )
 
 const (
 	beamCollectionName = "beams"
 )
 
+// The profile fields are maintained as particles are saved, and omitted
+// until the beam's first particle.  Times are unix seconds, like particle
+// timestamps.
 type beam struct {
-	Id         bson.ObjectId `bson:"_id"`
-	BeamId     string        `bson:"beam_id"`
-	Identifier string        `bson:"identifier"`
+	Id            bson.ObjectId     `bson:"_id" json:"-"`
+	BeamId        string            `bson:"beam_id" json:"beam_id"`
+	Identifier    string            `bson:"identifier" json:"identifier"`
+	FirstSeen     int64             `bson:"first_seen,omitempty" json:"first_seen,omitempty"`
+	LastSeen      int64             `bson:"last_seen,omitempty" json:"last_seen,omitempty"`
+	ParticleCount int64             `bson:"particle_count,omitempty" json:"particle_count,omitempty"`
+	FirstReferrer string            `bson:"first_referrer,omitempty" json:"first_referrer,omitempty"`
+	FirstUtm      map[string]string `bson:"first_utm,omitempty" json:"first_utm,omitempty"`
+	LandingPath   string            `bson:"landing_path,omitempty" json:"landing_path,omitempty"`
+	LastDevice    string            `bson:"last_device,omitempty" json:"last_device,omitempty"`
+	LinkedBeams   []string          `bson:"linked_beams,omitempty" json:"linked_beams,omitempty"`
 }
 
-func setupBeamsCollection(session *mgo.Session, config *TetryonConfig) error {
+func setupBeamsCollection(session *mgo.Session, s *site) error {
 	var err error
 	var collectionNames []string
 
 	sessionCopy := session.Copy()
 	defer sessionCopy.Close()
 
-	db := sessionCopy.DB(config.MongoConfig.Database)
+	db := sessionCopy.DB(s.Database)
 
 	collectionNames, err = db.CollectionNames()
 
@@ -33,12 +45,12 @@ func setupBeamsCollection(session *mgo.Session, config *TetryonConfig) error {
 	}
 
 	for _, collectionName := range collectionNames {
-		if collectionName == beamCollectionName {
+		if collectionName == s.CollectionPrefix+beamCollectionName {
 			return nil
 		}
 	}
 
-	beamCollection := db.C(beamCollectionName)
+	beamCollection := s.Collection(sessionCopy, beamCollectionName)
 
 	err = beamCollection.Create(&mgo.CollectionInfo{
 		DisableIdIndex: false,
@@ -55,7 +67,7 @@ func setupBeamsCollection(session *mgo.Session, config *TetryonConfig) error {
 		return err
 	}
 
-	log.Println("Created new collection: " + beamCollectionName)
+	log.Println("Created new collection: " + s.Database + "." + s.CollectionPrefix + beamCollectionName)
 
 	return nil
 }
@@ -80,24 +92,24 @@ func (b *beam) Init(params map[string]string) error {
 	return nil
 }
 
-func (b *beam) Save(session *mgo.Session, config *TetryonConfig) error {
+func (b *beam) Save(session *mgo.Session, s *site) error {
 	sessionCopy := session.Copy()
 	defer sessionCopy.Close()
 
-	beamCollection := sessionCopy.DB(config.MongoConfig.Database).C(beamCollectionName)
+	beamCollection := s.Collection(sessionCopy, beamCollectionName)
 
 	err := beamCollection.Insert(b)
 
 	return err
 }
 
-func GetBeamById(beamId string, session *mgo.Session, config *TetryonConfig) (*beam, error) {
+func GetBeamById(beamId string, session *mgo.Session, s *site) (*beam, error) {
 	var err error
 
 	sessionCopy := session.Copy()
 	defer sessionCopy.Close()
 
-	beamCollection := sessionCopy.DB(config.MongoConfig.Database).C(beamCollectionName)
+	beamCollection := s.Collection(sessionCopy, beamCollectionName)
 
 	b := &beam{}
 	err = beamCollection.Find(bson.M{"beam_id": beamId}).One(b)
@@ -110,7 +122,7 @@ func GetBeamById(beamId string, session *mgo.Session, config *TetryonConfig) (*b
 		params[paramBeamIdentifier] = beamId
 
 		b.Init(params)
-		err = b.Save(session, config)
+		err = b.Save(session, s)
 
 		if err != nil {
 			return nil, err
@@ -120,7 +132,7 @@ func GetBeamById(beamId string, session *mgo.Session, config *TetryonConfig) (*b
 	return b, nil
 }
 
-func (b *beam) Update(params map[string]string, session *mgo.Session, config *TetryonConfig) error {
+func (b *beam) Update(params map[string]string, session *mgo.Session, s *site) error {
 	if _, ok := params[paramBeamIdentifier]; ok {
 		b.Identifier = params[paramBeamIdentifier]
 	}
@@ -128,7 +140,7 @@ func (b *beam) Update(params map[string]string, session *mgo.Session, config *Te
 	sessionCopy := session.Copy()
 	defer sessionCopy.Close()
 
-	beamCollection := sessionCopy.DB(config.MongoConfig.Database).C(beamCollectionName)
+	beamCollection := s.Collection(sessionCopy, beamCollectionName)
 
 	var err error
 
@@ -138,7 +150,7 @@ func (b *beam) Update(params map[string]string, session *mgo.Session, config *Te
 		return err
 	}
 
-	err = b.ApplyBeamInfo(session, config)
+	err = b.ApplyBeamInfo(session, s)
 
 	if err != nil {
 		return err
@@ -147,13 +159,82 @@ func (b *beam) Update(params map[string]string, session *mgo.Session, config *Te
 	return nil
 }
 
-func (b *beam) ApplyBeamInfo(session *mgo.Session, config *TetryonConfig) error {
+func (b *beam) ApplyBeamInfo(session *mgo.Session, s *site) error {
 	sessionCopy := session.Copy()
 	defer sessionCopy.Close()
 
-	particleCollection := sessionCopy.DB(config.MongoConfig.Database).C(particleCollectionName)
+	particleCollection := s.Collection(sessionCopy, particleCollectionName)
 
 	_, err := particleCollection.UpdateAll(bson.M{"beam_id": b.BeamId}, bson.M{"$set": bson.M{"identifier": b.Identifier}})
 
 	return err
 }
+
+// The first touch of a particle: where the beam came from and landed.
+func beamFirstTouch(p *particle) bson.M {
+	firstTouch := bson.M{"landing_path": p.Path}
+
+	if referrer, _ := p.Data[sessionReferrerKey].(string); len(referrer) > 0 {
+		firstTouch["first_referrer"] = referrer
+	}
+
+	utm := make(map[string]string)
+	for key, data := range p.Data {
+		if value, ok := data.(string); ok && strings.HasPrefix(key, "utm_") {
+			utm[key] = value
+		}
+	}
+
+	if len(utm) > 0 {
+		firstTouch["first_utm"] = utm
+	}
+
+	return firstTouch
+}
+
+// Update the profile of a particle's beam, creating the beam if it doesn't
+// exist.  Beams created by a beam request have no first touch yet, so it is
+// set by their first particle.
+func UpdateBeamProfile(p *particle, session *mgo.Session, s *site) error {
+	sessionCopy := session.Copy()
+	defer sessionCopy.Close()
+
+	beamCollection := s.Collection(sessionCopy, beamCollectionName)
+
+	firstTouch := beamFirstTouch(p)
+
+	setOnInsert := bson.M{"_id": bson.NewObjectId(), "identifier": p.BeamId}
+	for key, value := range firstTouch {
+		setOnInsert[key] = value
+	}
+
+	change := mgo.Change{
+		Update: bson.M{
+			"$setOnInsert": setOnInsert,
+			"$min":         bson.M{"first_seen": p.Timestamp},
+			"$max":         bson.M{"last_seen": p.Timestamp},
+			"$inc":         bson.M{"particle_count": 1},
+			"$set":         bson.M{"last_device": p.UserAgent.Device},
+		},
+		Upsert: true,
+	}
+
+	previous := &beam{}
+	info, err := beamCollection.Find(bson.M{"beam_id": p.BeamId}).Apply(change, previous)
+
+	if err != nil {
+		return err
+	}
+
+	if info.Updated > 0 && previous.ParticleCount == 0 {
+		err = beamCollection.Update(
+			bson.M{"beam_id": p.BeamId, "landing_path": bson.M{"$exists": false}},
+			bson.M{"$set": firstTouch})
+
+		if err != nil && err != mgo.ErrNotFound {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"gopkg.in/mgo.v2"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	botParticleCollectionName = "bot_particles"
+)
+
+// Actions taken on a particle classified as a bot.
+const (
+	botActionDrop       = "drop"
+	botActionTag        = "tag"
+	botActionCollection = "collection"
+)
+
+// Classification rules.  User agent matches are counted as "user_agent:<name>"
+// using the name of the matching bot rule in useragents.json.
+const (
+	botRuleUserAgent  = "user_agent"
+	botRuleDatacenter = "datacenter"
+	botRuleRate       = "rate"
+	botRuleNoCookie   = "no_cookie"
+)
+
+// Upper bound on the number of beams tracked for the rate rule per window.
+const maxBotRateBeams = 100000
+
+// The beam ID the client sends when it could not store its cookie.
+const beamIdNoCookie = "false"
+
+type botFilter struct {
+	action        string
+	ruleActions   map[string]string
+	networks      []*net.IPNet
+	maxPerMinute  int
+	beamCounts    map[string]int
+	windowStarted time.Time
+	ruleCounts    map[string]int64
+	mutex         sync.Mutex
+}
+
+func loadBotFilter(botConfig BotConfig) (*botFilter, error) {
+	var err error
+
+	b := &botFilter{
+		action:        botConfig.Action,
+		ruleActions:   botConfig.RuleActions,
+		maxPerMinute:  botConfig.MaxParticlesPerMinute,
+		beamCounts:    make(map[string]int),
+		windowStarted: time.Now(),
+		ruleCounts:    make(map[string]int64),
+	}
+
+	if len(botConfig.Networks) > 0 {
+		if b.networks, err = loadBotNetworks(botConfig.Networks); err != nil {
+			return nil, err
+		}
+	}
+
+	return b, nil
+}
+
+// Load a list of CIDR ranges, one per line.  Blank lines and lines starting
+// with # are ignored.
+func loadBotNetworks(networksPath string) ([]*net.IPNet, error) {
+	networksFile, err := os.Open(networksPath)
+
+	if err != nil {
+		return nil, err
+	}
+	defer networksFile.Close()
+
+	var networks []*net.IPNet
+
+	scanner := bufio.NewScanner(networksFile)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+
+		if len(line) == 0 || line[0:1] == "#" {
+			continue
+		}
+
+		_, network, err := net.ParseCIDR(line)
+
+		if err != nil {
+			return nil, fmt.Errorf("Bot networks error: %s", err)
+		}
+
+		networks = append(networks, network)
+	}
+
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return networks, nil
+}
+
+func setupBotParticlesCollection(session *mgo.Session, s *site) error {
+	sessionCopy := session.Copy()
+	defer sessionCopy.Close()
+
+	botParticleCollection := s.Collection(sessionCopy, botParticleCollectionName)
+
+	return botParticleCollection.EnsureIndexKey("beam_id", "timestamp", "bot_rule")
+}
+
+// Classify a particle, tagging it if it matches any rule.
+// Returns the action to take, or an empty string if it is not a bot.
+func (b *botFilter) Classify(p *particle) string {
+	rule := ""
+
+	if p.UserAgent.Bot {
+		rule = botRuleUserAgent + ":" + p.UserAgent.botRule
+	} else if b.inNetworks(p.ip) {
+		rule = botRuleDatacenter
+	} else if !p.Signed && missingBeamCookie(p.BeamId) {
+		rule = botRuleNoCookie
+	} else if b.exceedsRate(p.BeamId) {
+		rule = botRuleRate
+	}
+
+	if len(rule) == 0 {
+		return ""
+	}
+
+	b.mutex.Lock()
+	b.ruleCounts[rule]++
+	b.mutex.Unlock()
+
+	p.IsBot = true
+	p.BotRule = rule
+
+	if action, ok := b.ruleActions[strings.SplitN(rule, ":", 2)[0]]; ok {
+		return action
+	}
+
+	return b.action
+}
+
+// Whether the client sent a particle without a beam cookie.  Only what the
+// client sends in that case counts, so custom beam IDs ( i.e. from servers )
+// aren't taken for bots.
+func missingBeamCookie(beamId string) bool {
+	return len(beamId) == 0 || beamId == beamIdNoCookie
+}
+
+func (b *botFilter) inNetworks(ip string) bool {
+	parsedIp := net.ParseIP(ip)
+
+	if parsedIp == nil {
+		return false
+	}
+
+	for _, network := range b.networks {
+		if network.Contains(parsedIp) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (b *botFilter) exceedsRate(beamId string) bool {
+	if b.maxPerMinute <= 0 {
+		return false
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if time.Since(b.windowStarted) >= time.Minute {
+		b.beamCounts = make(map[string]int)
+		b.windowStarted = time.Now()
+	}
+
+	if _, ok := b.beamCounts[beamId]; !ok && len(b.beamCounts) >= maxBotRateBeams {
+		return false
+	}
+
+	b.beamCounts[beamId]++
+
+	return b.beamCounts[beamId] > b.maxPerMinute
+}
+
+func logBotCounts(b *botFilter) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	rules := make([]string, 0, len(b.ruleCounts))
+	for rule := range b.ruleCounts {
+		rules = append(rules, rule)
+	}
+	sort.Strings(rules)
+
+	for _, rule := range rules {
+		log.Printf("Bot particles ( %s ): %d", rule, b.ruleCounts[rule])
+	}
+}
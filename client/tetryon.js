@@ -8,6 +8,7 @@
  * - serverUrl {String} The URL for the path to the Tetryon server.
  * - serverHttpPort {String} The port HTTP is running on.
  * - serverHttpsPort {String} The port HTTPS is running on.
+ * - siteKey {String} The public write key for your site, if the server hosts more than one.
  */
 var Tetryon = function (config) {
   this._config = config;
@@ -24,6 +25,10 @@ var Tetryon = function (config) {
                         ? this._config.serverHttpsPort
                         : 443;
 
+  this._siteKey = this._config.siteKey
+                ? this._config.siteKey
+                : null;
+
   if( this._serverUrl !== null ) {
 
     if( this._serverUrl.substr(this._serverUrl.length - 1) !== '/' ) {
@@ -54,9 +59,12 @@ var Tetryon = function (config) {
   this.__beamKey = this.__keyPrefix + 'Beam';
   this.__identifierKey = this.__keyPrefix + 'Identifier';
   this.__requestKey = this.__keyPrefix + 'Request';
+  this.__siteKeyKey = this.__keyPrefix + 'Key';
+  this.__linkKey = this.__keyPrefix + 'Link';
 
   this.__particleEndpoint = 'particle';
   this.__beamEndpoint = 'beam';
+  this.__linkEndpoint = 'link';
 
   this.__requestCharLimit = 2000;
 }
@@ -140,6 +148,39 @@ Tetryon.prototype._mergeDataObjects = function (a, b) {
   return data;
 }
 
+/**
+ * Flatten nested objects and arrays into keys the server expands again,
+ * i.e. { items: [ { sku: "A" } ] } becomes { "items[0].sku": "A" }.
+ * @param  {Object} data
+ * @param  {String} prefix Key of the object being flattened ( if nested ).
+ * @param  {Object} flat   The object to add flattened keys to.
+ * @return {Object}
+ */
+Tetryon.prototype._flattenData = function (data, prefix, flat) {
+  flat = flat || {};
+
+  var isArray = Object.prototype.toString.call(data) === '[object Array]';
+
+  for( var key in data ) {
+    if( ! data.hasOwnProperty(key) ) {
+      continue;
+    }
+
+    var flatKey = isArray
+                ? prefix + '[' + key + ']'
+                : ( prefix ? prefix + '.' + key : key );
+
+    if( data[key] !== null &&
+        typeof data[key] === "object" ) {
+      this._flattenData(data[key], flatKey, flat);
+    } else {
+      flat[flatKey] = data[key];
+    }
+  }
+
+  return flat;
+}
+
 /**
  * Get the unique ID for this client ( stored as a cookie )
  * If one doesn't exist, generate a new one and save it.
@@ -251,9 +292,12 @@ Tetryon.prototype._sendRequest = function (type, data, callback) {
   // These are reserved keys.
   delete data[this.__beamKey];
   delete data[this.__requestKey];
+  delete data[this.__siteKeyKey];
 
   data[this.__beamKey] = this._getBeamId();
 
+  data = this._flattenData(data);
+
   var queryStrings = [];
   var queryStringIndex = 0;
 
@@ -286,6 +330,11 @@ Tetryon.prototype._sendRequest = function (type, data, callback) {
   for( var i = 0; i < queryStrings.length; i++ ) {
     var requestParam = this._encodeRequestParam(requestId, (i + 1), queryStrings.length);
     queryStrings[i] += '&' + encodeURIComponent(this.__requestKey) + '=' + encodeURIComponent(requestParam);
+
+    // Every part carries the site key so the server can route it on its own.
+    if( this._siteKey !== null ) {
+      queryStrings[i] += '&' + encodeURIComponent(this.__siteKeyKey) + '=' + encodeURIComponent(this._siteKey);
+    }
   }
   
   var requestImages = [];
@@ -350,25 +399,146 @@ Tetryon.prototype.createParticle = function (event, params, callback) {
 /**
  * Send an internal ID to be applied to the beam for record lookup and association.
  * @param  {String} identifier The internal ID ( or string, email address, etc. ) to reference this beam.
- * @param  {Object} params     Additional information you want stored on the beam.
+ * @param  {Object} traits     Optional traits ( name, plan, etc. ) to store on the identifier.
  * @return {Boolean}
  */
-Tetryon.prototype.identifyBeam = function (identifier, callback) {
+Tetryon.prototype.identifyBeam = function (identifier, traits, callback) {
+  if( typeof traits === 'function' ) {
+    callback = traits;
+    traits = {};
+  }
+
   if( typeof callback === 'undefined' ) {
     callback = function() {};
   }
 
-  if( this._getIdentifier() == identifier ) {
+  var data = this._mergeDataObjects({}, traits);
+
+  if( this._getIdentifier() == identifier && Object.keys(data).length == 0 ) {
     return callback();
   }
 
-  var data = {};
-
   data[this.__identifierKey] = this._setIdentifier(identifier);
 
   return this._sendRequest('beam', data, callback);
 }
 
+/**
+ * Send a request to the link endpoint and pass the parsed response ( or null
+ * if it failed ) to the callback.
+ * @param  {Object}   data     Key/Value string pairs to send.
+ * @param  {Function} callback
+ */
+Tetryon.prototype._sendLinkRequest = function (data, callback) {
+  if( this._serverUrl === null ) {
+    throw "Missing serverUrl.";
+  }
+
+  if( this._siteKey !== null ) {
+    data[this.__siteKeyKey] = this._siteKey;
+  }
+
+  var queryString = "?";
+
+  for( var key in data ) {
+    if( queryString.length > 1 ) {
+      queryString += "&";
+    }
+    queryString += encodeURIComponent(key) + "=" + encodeURIComponent(data[key]);
+  }
+
+  var xhr = new XMLHttpRequest();
+
+  xhr.onreadystatechange = function () {
+    if( xhr.readyState !== 4 ) {
+      return;
+    }
+
+    var response = null;
+
+    if( xhr.status === 200 ) {
+      try {
+        response = JSON.parse(xhr.responseText);
+      } catch( e ) {
+        response = null;
+      }
+    }
+
+    callback(response);
+  };
+
+  xhr.open("GET", this._serverUrl + this.__linkEndpoint + queryString, true);
+  // Sends the cookie that proves this client owns its beam.
+  xhr.withCredentials = true;
+  xhr.send();
+
+  return true;
+}
+
+/**
+ * Add a link token for this beam to a URL on another of your domains, so the
+ * Tetryon client there can link its beam to this one ( see redeemLink ).
+ * @param  {String}   url      The URL to link to.
+ * @param  {Function} callback Called with the URL to use ( unchanged if no token could be issued ).
+ * @return {Boolean}
+ */
+Tetryon.prototype.linkUrl = function (url, callback) {
+  var data = {};
+  var linkKey = this.__linkKey;
+
+  data[this.__beamKey] = this._getBeamId();
+
+  return this._sendLinkRequest(data, function (response) {
+    if( response === null || !response.token ) {
+      return callback(url);
+    }
+
+    var hashIndex = url.indexOf('#');
+    var hash = hashIndex >= 0 ? url.substr(hashIndex) : '';
+
+    url = hashIndex >= 0 ? url.substr(0, hashIndex) : url;
+    url += ( url.indexOf('?') >= 0 ? '&' : '?' ) +
+           encodeURIComponent(linkKey) + '=' + encodeURIComponent(response.token);
+
+    callback(url + hash);
+  });
+}
+
+/**
+ * Redeem a link token in the current URL, if there is one.  This client's beam
+ * ( created if it has none yet ) and the linked beam are linked on the server
+ * and share an identifier.
+ * @param  {Function} callback Called with the server response, or null.
+ * @return {Boolean}
+ */
+Tetryon.prototype.redeemLink = function (callback) {
+  if( typeof callback === 'undefined' ) {
+    callback = function() {};
+  }
+
+  var token = null;
+  var queryParameters = document.location.search.substring(1).split('&');
+
+  for( var i = 0; i < queryParameters.length; i++ ) {
+    var keyValue = queryParameters[i].split('=');
+    if( decodeURIComponent(keyValue[0]) === this.__linkKey ) {
+      token = decodeURIComponent(keyValue[1] || '');
+    }
+  }
+
+  if( token === null ) {
+    callback(null);
+    return false;
+  }
+
+  var data = {};
+
+  data[this.__linkKey] = token;
+  data[this.__beamKey] = this._getBeamId();
+
+  return this._sendLinkRequest(data, callback);
+}
+
 /*
   :: cookies.js ::
 
@@ -3,14 +3,30 @@ package main
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io/ioutil"
+	"net/url"
 	"os"
 )
 
 type TetryonConfig struct {
-	MongoConfig MongoConfig `json:"mongodb"`
-	HttpConfig  HttpConfig  `json:"http"`
-	HttpsConfig HttpsConfig `json:"https"`
+	MongoConfig     MongoConfig     `json:"mongodb"`
+	HttpConfig      HttpConfig      `json:"http"`
+	HttpsConfig     HttpsConfig     `json:"https"`
+	UserAgentConfig UserAgentConfig `json:"useragent"`
+	BotConfig       BotConfig       `json:"bots"`
+	RateLimitConfig RateLimitConfig `json:"ratelimit"`
+	DomainConfig    DomainConfig    `json:"domains"`
+	SigningConfig   SigningConfig   `json:"signing"`
+	SiteConfigs     []SiteConfig    `json:"sites"`
+	QuotaConfig     QuotaConfig     `json:"quota"`
+	AdminConfig     AdminConfig     `json:"admin"`
+	SchemaConfig    SchemaConfig    `json:"schemas"`
+	LimitsConfig    LimitsConfig    `json:"limits"`
+	SessionConfig   SessionConfig   `json:"sessions"`
+	LinkingConfig   LinkingConfig   `json:"linking"`
+	UniquesConfig   UniquesConfig   `json:"uniques"`
+	WebhookConfigs  []WebhookConfig `json:"webhooks"`
 }
 
 type MongoConfig struct {
@@ -32,6 +48,109 @@ type HttpsConfig struct {
 	Cert     string `json:"cert"`
 }
 
+type UserAgentConfig struct {
+	Rules     string `json:"rules"`
+	CacheSize int    `json:"cache_size"`
+}
+
+type BotConfig struct {
+	Action                string            `json:"action"`
+	RuleActions           map[string]string `json:"rule_actions"`
+	Networks              string            `json:"networks"`
+	MaxParticlesPerMinute int               `json:"max_particles_per_minute"`
+}
+
+type RateLimitConfig struct {
+	IpRate    float64 `json:"ip_rate"`
+	IpBurst   int     `json:"ip_burst"`
+	BeamRate  float64 `json:"beam_rate"`
+	BeamBurst int     `json:"beam_burst"`
+	Response  string  `json:"response"`
+	MaxKeys   int     `json:"max_keys"`
+}
+
+type DomainConfig struct {
+	Allowed []string `json:"allowed"`
+	Action  string   `json:"action"`
+}
+
+// The secret and require flag apply to the default site; with a sites list
+// each site sets its own.
+type SigningConfig struct {
+	Secret             string `json:"secret"`
+	Require            bool   `json:"require"`
+	NonceWindowSeconds int    `json:"nonce_window"`
+}
+
+type SigningKey struct {
+	Secret  string `json:"secret"`
+	Require bool   `json:"require"`
+}
+
+type SiteConfig struct {
+	Id               string      `json:"id"`
+	Domains          []string    `json:"domains"`
+	Key              string      `json:"key"`
+	Database         string      `json:"database"`
+	CollectionPrefix string      `json:"collection_prefix"`
+	QuotaConfig      QuotaConfig `json:"quota"`
+	Signing          SigningKey  `json:"signing"`
+}
+
+type QuotaConfig struct {
+	DailySoft   int64   `json:"daily_soft"`
+	DailyHard   int64   `json:"daily_hard"`
+	MonthlySoft int64   `json:"monthly_soft"`
+	MonthlyHard int64   `json:"monthly_hard"`
+	SampleRate  float64 `json:"sample_rate"`
+}
+
+type LimitsConfig struct {
+	MaxDepth       int    `json:"max_depth"`
+	MaxArrayLength int    `json:"max_array_length"`
+	MaxKeyLength   int    `json:"max_key_length"`
+	MaxValueLength int    `json:"max_value_length"`
+	MaxKeys        int    `json:"max_keys"`
+	MaxRequestSize int    `json:"max_request_size"`
+	Action         string `json:"action"`
+}
+
+type SchemaConfig struct {
+	Path          string  `json:"path"`
+	LogSampleRate float64 `json:"log_sample_rate"`
+}
+
+type SessionConfig struct {
+	InactivityTimeout int `json:"inactivity_timeout"`
+}
+
+type LinkingConfig struct {
+	Secret          string `json:"secret"`
+	TokenTtlSeconds int    `json:"token_ttl"`
+}
+
+type UniquesConfig struct {
+	Node string `json:"node"`
+}
+
+type WebhookConfig struct {
+	Name         string            `json:"name"`
+	Url          string            `json:"url"`
+	Events       []string          `json:"events"`
+	Headers      map[string]string `json:"headers"`
+	Secret       string            `json:"secret"`
+	BatchSize    int               `json:"batch_size"`
+	BatchSeconds int               `json:"batch_wait"`
+	MaxAttempts  int               `json:"max_attempts"`
+	QueueSize    int               `json:"queue_size"`
+}
+
+type AdminConfig struct {
+	Hostname string `json:"hostname"`
+	Port     string `json:"port"`
+	Token    string `json:"token"`
+}
+
 func loadTetryonConfig(configPath string) (*TetryonConfig, error) {
 
 	if configPath[len(configPath)-1:] != "/" {
@@ -97,5 +216,202 @@ func loadTetryonConfig(configPath string) (*TetryonConfig, error) {
 		tetryonConfig.HttpsConfig.Key = configPath + tetryonConfig.HttpsConfig.Key
 	}
 
+	if len(tetryonConfig.UserAgentConfig.Rules) > 0 &&
+		tetryonConfig.UserAgentConfig.Rules[0:1] != "/" {
+		tetryonConfig.UserAgentConfig.Rules = configPath + tetryonConfig.UserAgentConfig.Rules
+	}
+
+	if len(tetryonConfig.BotConfig.Action) == 0 {
+		tetryonConfig.BotConfig.Action = botActionTag
+	}
+
+	if !validBotAction(tetryonConfig.BotConfig.Action) {
+		return nil, errors.New("Config error: invalid bots.action " + tetryonConfig.BotConfig.Action)
+	}
+
+	for rule, action := range tetryonConfig.BotConfig.RuleActions {
+		if !validBotAction(action) {
+			return nil, errors.New("Config error: invalid bots.rule_actions." + rule + " " + action)
+		}
+	}
+
+	if len(tetryonConfig.RateLimitConfig.Response) == 0 {
+		tetryonConfig.RateLimitConfig.Response = rateLimitResponseDrop
+	}
+
+	if tetryonConfig.RateLimitConfig.Response != rateLimitResponseDrop &&
+		tetryonConfig.RateLimitConfig.Response != rateLimitResponseReject {
+		return nil, errors.New("Config error: invalid ratelimit.response " + tetryonConfig.RateLimitConfig.Response)
+	}
+
+	if len(tetryonConfig.DomainConfig.Action) == 0 {
+		tetryonConfig.DomainConfig.Action = domainActionReject
+	}
+
+	if tetryonConfig.DomainConfig.Action != domainActionReject &&
+		tetryonConfig.DomainConfig.Action != domainActionQuarantine {
+		return nil, errors.New("Config error: invalid domains.action " + tetryonConfig.DomainConfig.Action)
+	}
+
+	if !validQuota(tetryonConfig.QuotaConfig) {
+		return nil, errors.New("Config error: quota.sample_rate must be between 0 and 1, and above 0 with a soft limit")
+	}
+
+	siteIds := make(map[string]bool)
+	siteKeys := make(map[string]bool)
+	siteCollections := make(map[string]string)
+
+	for i := range tetryonConfig.SiteConfigs {
+		siteConfig := &tetryonConfig.SiteConfigs[i]
+
+		if len(siteConfig.Id) == 0 {
+			return nil, fmt.Errorf("Config error: missing sites[%d].id", i)
+		}
+
+		if siteIds[siteConfig.Id] {
+			return nil, errors.New("Config error: duplicate site id " + siteConfig.Id)
+		}
+		siteIds[siteConfig.Id] = true
+
+		if len(siteConfig.Key) > 0 {
+			if siteKeys[siteConfig.Key] {
+				return nil, errors.New("Config error: duplicate key for site " + siteConfig.Id)
+			}
+			siteKeys[siteConfig.Key] = true
+		}
+
+		if siteConfig.Signing.Require && len(siteConfig.Signing.Secret) == 0 {
+			return nil, errors.New("Config error: missing sites." + siteConfig.Id + ".signing.secret")
+		}
+
+		if !validQuota(siteConfig.QuotaConfig) {
+			return nil, errors.New("Config error: sites." + siteConfig.Id + ".quota.sample_rate must be between 0 and 1, and above 0 with a soft limit")
+		}
+
+		if len(siteConfig.Database) == 0 {
+			siteConfig.Database = tetryonConfig.MongoConfig.Database
+		}
+
+		// Documents don't record their site, so sites can't share collections.
+		collections := siteConfig.Database + "." + siteConfig.CollectionPrefix
+
+		if other, ok := siteCollections[collections]; ok {
+			return nil, errors.New("Config error: sites " + other + " and " + siteConfig.Id + " share a database and collection_prefix")
+		}
+		siteCollections[collections] = siteConfig.Id
+	}
+
+	if len(tetryonConfig.AdminConfig.Port) > 0 &&
+		len(tetryonConfig.AdminConfig.Token) == 0 {
+		return nil, errors.New("Config error: missing admin.token")
+	}
+
+	if tetryonConfig.SigningConfig.Require &&
+		len(tetryonConfig.SigningConfig.Secret) == 0 {
+		return nil, errors.New("Config error: missing signing.secret")
+	}
+
+	if tetryonConfig.LimitsConfig.MaxDepth <= 0 {
+		tetryonConfig.LimitsConfig.MaxDepth = defaultMaxDataDepth
+	}
+
+	if tetryonConfig.LimitsConfig.MaxArrayLength <= 0 {
+		tetryonConfig.LimitsConfig.MaxArrayLength = defaultMaxDataArrayLength
+	}
+
+	if tetryonConfig.LimitsConfig.MaxKeyLength <= 0 {
+		tetryonConfig.LimitsConfig.MaxKeyLength = defaultMaxKeyLength
+	}
+
+	if tetryonConfig.LimitsConfig.MaxValueLength <= 0 {
+		tetryonConfig.LimitsConfig.MaxValueLength = defaultMaxValueLength
+	}
+
+	if tetryonConfig.LimitsConfig.MaxKeys <= 0 {
+		tetryonConfig.LimitsConfig.MaxKeys = defaultMaxKeys
+	}
+
+	if tetryonConfig.LimitsConfig.MaxRequestSize <= 0 {
+		tetryonConfig.LimitsConfig.MaxRequestSize = defaultMaxRequestSize
+	}
+
+	if len(tetryonConfig.LimitsConfig.Action) == 0 {
+		tetryonConfig.LimitsConfig.Action = limitActionTruncate
+	}
+
+	if tetryonConfig.LimitsConfig.Action != limitActionTruncate &&
+		tetryonConfig.LimitsConfig.Action != limitActionReject {
+		return nil, errors.New("Config error: invalid limits.action " + tetryonConfig.LimitsConfig.Action)
+	}
+
+	if tetryonConfig.SessionConfig.InactivityTimeout <= 0 {
+		tetryonConfig.SessionConfig.InactivityTimeout = defaultSessionInactivityTimeout
+	}
+
+	webhookNames := make(map[string]bool)
+
+	for i := range tetryonConfig.WebhookConfigs {
+		webhookConfig := &tetryonConfig.WebhookConfigs[i]
+
+		if len(webhookConfig.Name) == 0 {
+			return nil, fmt.Errorf("Config error: missing webhooks[%d].name", i)
+		}
+
+		if webhookNames[webhookConfig.Name] {
+			return nil, errors.New("Config error: duplicate webhook name " + webhookConfig.Name)
+		}
+		webhookNames[webhookConfig.Name] = true
+
+		if webhookUrl, err := url.Parse(webhookConfig.Url); err != nil ||
+			(webhookUrl.Scheme != "http" && webhookUrl.Scheme != "https") {
+			return nil, errors.New("Config error: invalid webhooks." + webhookConfig.Name + ".url")
+		}
+
+		if len(webhookConfig.Events) == 0 {
+			return nil, errors.New("Config error: missing webhooks." + webhookConfig.Name + ".events")
+		}
+
+		if webhookConfig.BatchSize <= 0 {
+			webhookConfig.BatchSize = defaultWebhookBatchSize
+		}
+
+		if webhookConfig.BatchSeconds <= 0 {
+			webhookConfig.BatchSeconds = defaultWebhookBatchSeconds
+		}
+
+		if webhookConfig.MaxAttempts <= 0 {
+			webhookConfig.MaxAttempts = defaultWebhookMaxAttempts
+		}
+
+		if webhookConfig.QueueSize <= 0 {
+			webhookConfig.QueueSize = defaultWebhookQueueSize
+		}
+	}
+
+	if len(tetryonConfig.SchemaConfig.Path) > 0 &&
+		tetryonConfig.SchemaConfig.Path[0:1] != "/" {
+		tetryonConfig.SchemaConfig.Path = configPath + tetryonConfig.SchemaConfig.Path
+	}
+
+	if len(tetryonConfig.BotConfig.Networks) > 0 &&
+		tetryonConfig.BotConfig.Networks[0:1] != "/" {
+		tetryonConfig.BotConfig.Networks = configPath + tetryonConfig.BotConfig.Networks
+	}
+
 	return &tetryonConfig, nil
 }
+
+// A sample rate of 0 would turn soft limits into hard ones.
+func validQuota(quota QuotaConfig) bool {
+	if quota.SampleRate < 0 || quota.SampleRate > 1 {
+		return false
+	}
+
+	return (quota.DailySoft == 0 && quota.MonthlySoft == 0) || quota.SampleRate > 0
+}
+
+func validBotAction(action string) bool {
+	return action == botActionDrop ||
+		action == botActionTag ||
+		action == botActionCollection
+}
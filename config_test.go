@@ -0,0 +1,25 @@
+package main
+
+import "testing"
+
+func TestValidQuota(t *testing.T) {
+	tests := []struct {
+		quota QuotaConfig
+		valid bool
+	}{
+		{QuotaConfig{}, true},
+		{QuotaConfig{DailyHard: 100}, true},
+		{QuotaConfig{DailySoft: 100, SampleRate: 0.1}, true},
+		{QuotaConfig{MonthlySoft: 100, SampleRate: 1}, true},
+		{QuotaConfig{DailySoft: 100}, false},
+		{QuotaConfig{MonthlySoft: 100}, false},
+		{QuotaConfig{SampleRate: -0.1}, false},
+		{QuotaConfig{DailySoft: 100, SampleRate: 1.5}, false},
+	}
+
+	for _, test := range tests {
+		if valid := validQuota(test.quota); valid != test.valid {
+			t.Errorf("validQuota(%+v) = %v, want %v", test.quota, valid, test.valid)
+		}
+	}
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"embed"
+	"io/fs"
+	"log"
+	"net/http"
+)
+
+const dashboardPath = "/dashboard/"
+
+// The dashboard is static files built into the binary.  It holds no data
+// itself; the page asks for the admin token and sends it with its calls to
+// the stats, query and stream APIs.
+//
+//go:embed dashboard
+var dashboardFiles embed.FS
+
+func handleDashboardRequest() http.Handler {
+	files, err := fs.Sub(dashboardFiles, "dashboard")
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	return http.StripPrefix(dashboardPath, http.FileServer(http.FS(files)))
+}
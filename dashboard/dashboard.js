@@ -0,0 +1,347 @@
+/**
+ * Tetryon dashboard
+ * Reads the admin APIs of the listener it is served from.  The admin token is
+ * kept in sessionStorage and sent as a bearer token with every call.
+ */
+(function () {
+	'use strict';
+
+	var TOP_LIMIT = 10;
+	var RECENT_LIMIT = 20;
+	var RATE_SECONDS = 60;
+	var REFRESH_SECONDS = 60;
+
+	var state = {
+		token: sessionStorage.getItem('tetryonToken') || '',
+		site: sessionStorage.getItem('tetryonSite') || '',
+		range: 86400,
+		stream: null,
+		refresh: null,
+		// Particles received in each of the last RATE_SECONDS seconds.
+		rate: [],
+		rateSecond: 0
+	};
+
+	function $(id) {
+		return document.getElementById(id);
+	}
+
+	function setStatus(message) {
+		$('status').textContent = message || '';
+	}
+
+	function apiUrl(path, params) {
+		var query = [];
+
+		if (state.site.length > 0) {
+			params.site = state.site;
+		}
+
+		for (var key in params) {
+			if (params.hasOwnProperty(key)) {
+				query.push(encodeURIComponent(key) + '=' + encodeURIComponent(params[key]));
+			}
+		}
+
+		return path + (query.length > 0 ? '?' + query.join('&') : '');
+	}
+
+	function api(path, params) {
+		return fetch(apiUrl(path, params), {
+			headers: { 'Authorization': 'Bearer ' + state.token }
+		}).then(function (response) {
+			return response.json().then(function (body) {
+				if (!response.ok) {
+					throw new Error(body.error || response.statusText);
+				}
+				return body;
+			});
+		});
+	}
+
+	function formatTime(timestamp) {
+		return new Date(timestamp * 1000).toLocaleString();
+	}
+
+	function cell(row, text, className) {
+		var td = document.createElement('td');
+		td.textContent = text;
+		td.title = text;
+		if (className) {
+			td.className = className;
+		}
+		row.appendChild(td);
+	}
+
+	function particleRow(p) {
+		var row = document.createElement('tr');
+		cell(row, formatTime(p.timestamp));
+		cell(row, p.event);
+		cell(row, p.domain);
+		cell(row, p.path);
+		cell(row, p.beam_id);
+		return row;
+	}
+
+	/**
+	 * Sum stats buckets by group, and render the largest.
+	 */
+	function renderTop(id, buckets) {
+		var totals = {};
+		var groups = [];
+
+		buckets.forEach(function (bucket) {
+			if (bucket.group === null || bucket.group === undefined || bucket.group === '') {
+				return;
+			}
+
+			var group = String(bucket.group);
+			if (!totals.hasOwnProperty(group)) {
+				totals[group] = 0;
+				groups.push(group);
+			}
+			totals[group] += bucket.particles;
+		});
+
+		groups.sort(function (a, b) {
+			return totals[b] - totals[a];
+		});
+
+		var tbody = $(id);
+		tbody.innerHTML = '';
+
+		groups.slice(0, TOP_LIMIT).forEach(function (group) {
+			var row = document.createElement('tr');
+			cell(row, group);
+			cell(row, totals[group], 'count');
+			tbody.appendChild(row);
+		});
+	}
+
+	function loadTop(id, params) {
+		var now = Math.floor(Date.now() / 1000);
+
+		params.from = now - state.range;
+		params.to = now;
+		params.interval = state.range > 86400 ? 'day' : 'hour';
+
+		return api('/v1/stats', params).then(function (buckets) {
+			renderTop(id, buckets);
+		});
+	}
+
+	function loadTops() {
+		Promise.all([
+			loadTop('top-events', { source: 'rollups', group_by: 'event' }),
+			loadTop('top-pages', { source: 'rollups', group_by: 'path' }),
+			// There is no referrer rollup, so this counts raw particles - without
+			// the unique counts, which are the expensive part.
+			loadTop('top-referrers', { group_by: 'data.referer', uniques: 'false' }),
+			loadTop('top-campaigns', { source: 'rollups', group_by: 'campaign' })
+		]).catch(function (err) {
+			setStatus(err.message);
+		});
+	}
+
+	function tickRate() {
+		var second = Math.floor(Date.now() / 1000);
+
+		while (state.rateSecond < second) {
+			state.rate.push(0);
+			state.rateSecond++;
+		}
+
+		if (state.rate.length > RATE_SECONDS) {
+			state.rate = state.rate.slice(state.rate.length - RATE_SECONDS);
+		}
+	}
+
+	function renderRate() {
+		tickRate();
+
+		var total = 0;
+		var max = 1;
+
+		state.rate.forEach(function (count) {
+			total += count;
+			max = Math.max(max, count);
+		});
+
+		$('rate').textContent = total;
+
+		var canvas = $('rate-chart');
+		var context = canvas.getContext('2d');
+		var width = canvas.width / RATE_SECONDS;
+
+		context.clearRect(0, 0, canvas.width, canvas.height);
+		context.fillStyle = '#4a7bd0';
+
+		state.rate.forEach(function (count, i) {
+			var height = canvas.height * count / max;
+			context.fillRect(i * width, canvas.height - height, width - 1, height);
+		});
+	}
+
+	function receiveParticle(p) {
+		tickRate();
+		state.rate[state.rate.length - 1]++;
+
+		var tbody = $('recent');
+		tbody.insertBefore(particleRow(p), tbody.firstChild);
+
+		while (tbody.childNodes.length > RECENT_LIMIT) {
+			tbody.removeChild(tbody.lastChild);
+		}
+	}
+
+	/**
+	 * Handle one Server-Sent Event block.
+	 */
+	function receiveEvent(block) {
+		var type = 'message';
+		var data = [];
+
+		block.split('\n').forEach(function (line) {
+			if (line.indexOf('event:') === 0) {
+				type = line.slice(6).trim();
+			} else if (line.indexOf('data:') === 0) {
+				data.push(line.slice(5).trim());
+			}
+		});
+
+		if (data.length === 0) {
+			return;
+		}
+
+		var body = JSON.parse(data.join('\n'));
+
+		if (type === 'particle') {
+			receiveParticle(body);
+		} else if (type === 'dropped') {
+			$('dropped').textContent = '( ' + body.dropped + ' dropped )';
+		}
+	}
+
+	/**
+	 * EventSource can't send an Authorization header, so the stream is read
+	 * with fetch.
+	 */
+	function openStream() {
+		var controller = new AbortController();
+		var decoder = new TextDecoder();
+		var buffer = '';
+
+		state.stream = controller;
+
+		fetch(apiUrl('/v1/stream', {}), {
+			headers: { 'Authorization': 'Bearer ' + state.token },
+			signal: controller.signal
+		}).then(function (response) {
+			if (!response.ok) {
+				throw new Error('Stream: ' + response.statusText);
+			}
+
+			var reader = response.body.getReader();
+
+			function read() {
+				return reader.read().then(function (result) {
+					if (result.done) {
+						throw new Error('Stream closed');
+					}
+
+					buffer += decoder.decode(result.value, { stream: true });
+
+					var blocks = buffer.split('\n\n');
+					buffer = blocks.pop();
+					blocks.forEach(receiveEvent);
+
+					return read();
+				});
+			}
+
+			return read();
+		}).catch(function (err) {
+			if (state.stream === controller) {
+				setStatus(err.message);
+			}
+		});
+	}
+
+	function connect() {
+		if (state.stream) {
+			state.stream.abort();
+			state.stream = null;
+		}
+
+		if (state.refresh) {
+			clearInterval(state.refresh);
+		}
+
+		setStatus('');
+		state.rate = [0];
+		state.rateSecond = Math.floor(Date.now() / 1000);
+		$('recent').innerHTML = '';
+		$('dropped').textContent = '';
+
+		openStream();
+		loadTops();
+		state.refresh = setInterval(loadTops, REFRESH_SECONDS * 1000);
+	}
+
+	function lookup() {
+		var by = $('lookup-by').value;
+		var value = $('lookup-value').value.trim();
+		var request;
+
+		if (value.length === 0) {
+			return;
+		}
+
+		if (by === 'beam') {
+			request = api('/v1/particles', { beam_id: value, order: 'desc', limit: 50 });
+		} else {
+			request = api('/v1/identities/' + encodeURIComponent(value) + '/timeline', { order: 'desc', limit: 50 });
+		}
+
+		request.then(function (page) {
+			var particles = page.particles || page.entries || [];
+			var tbody = $('lookup-results');
+
+			$('lookup-traits').textContent = page.traits ? JSON.stringify(page.traits, null, 2) : '';
+
+			tbody.innerHTML = '';
+			particles.forEach(function (p) {
+				tbody.appendChild(particleRow(p));
+			});
+		}).catch(function (err) {
+			setStatus(err.message);
+		});
+	}
+
+	$('token').value = state.token;
+	$('site').value = state.site;
+
+	$('connect').addEventListener('submit', function (e) {
+		e.preventDefault();
+
+		state.token = $('token').value;
+		state.site = $('site').value.trim();
+		state.range = parseInt($('range').value, 10);
+
+		sessionStorage.setItem('tetryonToken', state.token);
+		sessionStorage.setItem('tetryonSite', state.site);
+
+		connect();
+	});
+
+	$('lookup-form').addEventListener('submit', function (e) {
+		e.preventDefault();
+		lookup();
+	});
+
+	setInterval(renderRate, 1000);
+
+	if (state.token.length > 0) {
+		connect();
+	}
+})();
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"gopkg.in/mgo.v2"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+const (
+	quarantinedParticleCollectionName = "quarantined_particles"
+)
+
+// Actions taken on a particle from a domain that is not allowed.
+const (
+	domainActionReject     = "reject"
+	domainActionQuarantine = "quarantine"
+)
+
+// Reasons recorded on quarantined particles.
+const (
+	quarantineDomain = "domain"
+	quarantineOrigin = "origin"
+)
+
+// Allowed domains are exact hostnames, "*.example.com" for any subdomain of
+// example.com, or "*" for everything.  An empty list allows everything.
+type domainAllowlist struct {
+	action   string
+	allowed  []string
+	rejected int64
+	mutex    sync.Mutex
+}
+
+func loadDomainAllowlist(domainConfig DomainConfig) *domainAllowlist {
+	allowed := make([]string, 0, len(domainConfig.Allowed))
+
+	for _, domain := range domainConfig.Allowed {
+		allowed = append(allowed, strings.ToLower(domain))
+	}
+
+	return &domainAllowlist{
+		action:  domainConfig.Action,
+		allowed: allowed,
+	}
+}
+
+func setupQuarantinedParticlesCollection(session *mgo.Session, s *site) error {
+	sessionCopy := session.Copy()
+	defer sessionCopy.Close()
+
+	quarantinedParticleCollection := s.Collection(sessionCopy, quarantinedParticleCollectionName)
+
+	return quarantinedParticleCollection.EnsureIndexKey("domain", "timestamp", "quarantine")
+}
+
+func (d *domainAllowlist) Allows(host string) bool {
+	return len(d.allowed) == 0 || d.Matches(host)
+}
+
+// Whether host is explicitly listed, ignoring the empty list case.
+func (d *domainAllowlist) Matches(host string) bool {
+	host = strings.ToLower(stripPort(host))
+
+	for _, domain := range d.allowed {
+		if domain == "*" || domain == host {
+			return true
+		}
+
+		if strings.HasPrefix(domain, "*.") && strings.HasSuffix(host, domain[1:]) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Check the origin of a particle request against the allowlist.  Returns the
+// reason the request is not allowed, or an empty string if it is.
+func (d *domainAllowlist) CheckOrigin(r *http.Request) string {
+	if origin := requestOrigin(r); len(origin) > 0 && !d.Allows(origin) {
+		return quarantineOrigin
+	}
+
+	return ""
+}
+
+// Check the domain parameter of a reassembled particle request, which may
+// have been sent in any of its parts.  Quarantines the request, or returns
+// false if it must be discarded.
+func (d *domainAllowlist) CheckDomain(params map[string]string) bool {
+	if domain, ok := params[paramDomain]; !ok || d.Allows(domain) {
+		return true
+	}
+
+	if d.action == domainActionReject {
+		d.mutex.Lock()
+		d.rejected++
+		d.mutex.Unlock()
+		return false
+	}
+
+	if len(params[paramQuarantine]) == 0 {
+		params[paramQuarantine] = quarantineDomain
+	}
+
+	return true
+}
+
+func (d *domainAllowlist) Rejected() int64 {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	return d.rejected
+}
+
+func logDomainRejections(sites *siteRouter) {
+	for _, s := range sites.Sites() {
+		log.Printf("Rejected particles ( domain, %s ): %d", s.Id, s.domains.Rejected())
+	}
+}
+
+// The host of the Origin header, or of the Referer if there is no Origin.
+func requestOrigin(r *http.Request) string {
+	origin := r.Header.Get("Origin")
+
+	if len(origin) == 0 || origin == "null" {
+		origin = r.Referer()
+	}
+
+	if len(origin) == 0 {
+		return ""
+	}
+
+	originUrl, err := url.Parse(origin)
+
+	if err != nil {
+		return ""
+	}
+
+	return originUrl.Host
+}
+
+func stripPort(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+
+	return host
+}
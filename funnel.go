@@ -0,0 +1,341 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultFunnelWindowSeconds = 7 * 86400
+	maxFunnelSteps             = 20
+	maxFunnelRequestSize       = 65536
+)
+
+// Who a funnel follows: identifiers ( across all their beams ) or beams.
+const (
+	funnelByIdentifier = "identifier"
+	funnelByBeam       = "beam"
+)
+
+// A funnel is an ordered list of steps, i.e. visit /pricing, then signup,
+// then purchase.  A step matches a particle by its event, and optionally its
+// path and data values ( compared as strings ).
+type funnel struct {
+	Site          string       `json:"site"`
+	Steps         []funnelStep `json:"steps"`
+	WindowSeconds int64        `json:"window"`
+	By            string       `json:"by"`
+	From          int64        `json:"from"`
+	To            int64        `json:"to"`
+}
+
+type funnelStep struct {
+	Event string            `json:"event"`
+	Path  string            `json:"path,omitempty"`
+	Data  map[string]string `json:"data,omitempty"`
+}
+
+// How many reached each step, and what fraction of the first and previous
+// steps that is.
+type funnelStepResult struct {
+	funnelStep
+	Count              int64   `json:"count"`
+	Conversion         float64 `json:"conversion"`
+	PreviousConversion float64 `json:"previous_conversion"`
+}
+
+type funnelResult struct {
+	By    string             `json:"by"`
+	From  int64              `json:"from"`
+	To    int64              `json:"to"`
+	Steps []funnelStepResult `json:"steps"`
+}
+
+// One particle, as read for a funnel.
+type funnelParticle struct {
+	Key       string                 `bson:"key"`
+	Timestamp int64                  `bson:"timestamp"`
+	Event     string                 `bson:"event"`
+	Path      string                 `bson:"path"`
+	Data      map[string]interface{} `bson:"data"`
+}
+
+// Check a funnel and fill in its defaults: the last week, followed by
+// identifier, with a window of a week.
+func (f *funnel) validate() error {
+	if len(f.Steps) == 0 {
+		return errors.New("missing steps")
+	}
+
+	if len(f.Steps) > maxFunnelSteps {
+		return errors.New("too many steps, at most " + strconv.Itoa(maxFunnelSteps))
+	}
+
+	for i, step := range f.Steps {
+		if len(step.Event) == 0 {
+			return fmt.Errorf("missing steps[%d].event", i)
+		}
+
+		for key := range step.Data {
+			if len(key) == 0 || strings.ContainsAny(key, ".$") {
+				return fmt.Errorf("invalid steps[%d].data key: %s", i, key)
+			}
+		}
+	}
+
+	if f.WindowSeconds <= 0 {
+		f.WindowSeconds = defaultFunnelWindowSeconds
+	}
+
+	if len(f.By) == 0 {
+		f.By = funnelByIdentifier
+	}
+
+	if f.By != funnelByIdentifier && f.By != funnelByBeam {
+		return errors.New("invalid by: " + f.By)
+	}
+
+	if f.To == 0 {
+		f.To = time.Now().Unix()
+	}
+
+	if f.From == 0 {
+		f.From = f.To - defaultFunnelWindowSeconds
+	}
+
+	if f.From >= f.To {
+		return errors.New("from must be before to")
+	}
+
+	return nil
+}
+
+func (step *funnelStep) matches(p *funnelParticle) bool {
+	if p.Event != step.Event {
+		return false
+	}
+
+	if len(step.Path) > 0 && p.Path != step.Path {
+		return false
+	}
+
+	for key, value := range step.Data {
+		data, ok := p.Data[key]
+
+		if !ok || fmt.Sprint(data) != value {
+			return false
+		}
+	}
+
+	return true
+}
+
+// How far one identifier ( or beam ) got through a funnel, from its particles
+// in time order: the furthest step reached from any start in the range,
+// taking the steps in order within the window.  starts[k] is the latest start
+// that reached step k, as a later start leaves the most of the window for
+// the steps after it; it is set for every step below reached.
+type funnelProgress struct {
+	funnel  *funnel
+	key     string
+	starts  []int64
+	reached int
+}
+
+func newFunnelProgress(f *funnel) *funnelProgress {
+	return &funnelProgress{funnel: f, starts: make([]int64, len(f.Steps))}
+}
+
+func (g *funnelProgress) Add(p *funnelParticle) {
+	f := g.funnel
+
+	// From the last step down, so a particle only ever takes one step.
+	for k := len(f.Steps) - 1; k > 0; k-- {
+		if k > g.reached || p.Timestamp-g.starts[k-1] > f.WindowSeconds || !f.Steps[k].matches(p) {
+			continue
+		}
+
+		g.starts[k] = g.starts[k-1]
+
+		if k == g.reached {
+			g.reached++
+		}
+	}
+
+	if p.Timestamp >= f.From && p.Timestamp < f.To && f.Steps[0].matches(p) {
+		g.starts[0] = p.Timestamp
+
+		if g.reached == 0 {
+			g.reached = 1
+		}
+	}
+}
+
+func (f *funnel) pipeline() []bson.M {
+	key := "$identifier"
+	if f.By == funnelByBeam {
+		key = "$beam_id"
+	}
+
+	var events []string
+	project := bson.M{"_id": 0, "key": key, "timestamp": 1, "event": 1, "path": 1}
+
+	// Cookieless particles all share one beam ID ( and identifier ), so they
+	// can't be followed through a funnel.
+	field := key[1:]
+
+	for _, step := range f.Steps {
+		events = append(events, step.Event)
+
+		for dataKey := range step.Data {
+			project["data."+dataKey] = 1
+		}
+	}
+
+	return []bson.M{
+		{"$match": bson.M{
+			"event":     bson.M{"$in": events},
+			"timestamp": bson.M{"$gte": f.From, "$lt": f.To + f.WindowSeconds},
+			field:       bson.M{"$ne": beamIdNoCookie},
+		}},
+		{"$project": project},
+		{"$sort": bson.D{{Name: "key", Value: 1}, {Name: "timestamp", Value: 1}}},
+	}
+}
+
+// Count how many identifiers ( or beams ) reached each step of the funnel.
+// Particles are streamed in order of identifier, and each is looked at once.
+func GetFunnel(session *mgo.Session, s *site, f *funnel) (*funnelResult, error) {
+	sessionCopy := session.Copy()
+	defer sessionCopy.Close()
+
+	particleCollection := s.Collection(sessionCopy, particleCollectionName)
+
+	counts := make([]int64, len(f.Steps))
+
+	count := func(progress *funnelProgress) {
+		for step := 0; step < progress.reached; step++ {
+			counts[step]++
+		}
+	}
+
+	var progress *funnelProgress
+	var p funnelParticle
+
+	iter := particleCollection.Pipe(f.pipeline()).AllowDiskUse().Iter()
+
+	for iter.Next(&p) {
+		if progress == nil || progress.key != p.Key {
+			if progress != nil {
+				count(progress)
+			}
+
+			progress = newFunnelProgress(f)
+			progress.key = p.Key
+		}
+
+		progress.Add(&p)
+		p = funnelParticle{}
+	}
+
+	if err := iter.Close(); err != nil {
+		return nil, err
+	}
+
+	if progress != nil {
+		count(progress)
+	}
+
+	result := &funnelResult{By: f.By, From: f.From, To: f.To}
+
+	for i, step := range f.Steps {
+		stepResult := funnelStepResult{funnelStep: step, Count: counts[i]}
+
+		if counts[0] > 0 {
+			stepResult.Conversion = float64(counts[i]) / float64(counts[0])
+		}
+
+		if i == 0 {
+			stepResult.PreviousConversion = stepResult.Conversion
+		} else if counts[i-1] > 0 {
+			stepResult.PreviousConversion = float64(counts[i]) / float64(counts[i-1])
+		}
+
+		result.Steps = append(result.Steps, stepResult)
+	}
+
+	return result, nil
+}
+
+// POST /v1/funnels with a funnel as the JSON body:
+//
+//	{
+//	  "site": "shop",
+//	  "steps": [
+//	    { "event": "visit", "path": "/pricing" },
+//	    { "event": "signup" },
+//	    { "event": "purchase", "data": { "plan": "pro" } }
+//	  ],
+//	  "window": 86400,
+//	  "by": "identifier",
+//	  "from": 1420070400,
+//	  "to": 1422748800
+//	}
+//
+// A funnel starts with a first step in [from, to), and its other steps must
+// follow within window seconds.
+func handleFunnelsRequest(session *mgo.Session, sites *siteRouter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			writeJsonError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+
+		var f funnel
+
+		body := http.MaxBytesReader(w, r.Body, maxFunnelRequestSize)
+
+		if err := json.NewDecoder(body).Decode(&f); err != nil {
+			writeJsonError(w, http.StatusBadRequest, "invalid funnel: "+err.Error())
+			return
+		}
+
+		if err := f.validate(); err != nil {
+			writeJsonError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		if len(f.Site) == 0 {
+			if len(sites.Sites()) > 1 {
+				writeJsonError(w, http.StatusBadRequest, "missing site")
+				return
+			}
+			f.Site = sites.Sites()[0].Id
+		}
+
+		s, ok := sites.Get(f.Site)
+
+		if !ok {
+			writeJsonError(w, http.StatusNotFound, "unknown site: "+f.Site)
+			return
+		}
+
+		result, err := GetFunnel(session, s, &f)
+
+		if err != nil {
+			log.Println(err)
+			writeJsonError(w, http.StatusInternalServerError, "could not compute funnel")
+			return
+		}
+
+		writeJson(w, http.StatusOK, result)
+	}
+}
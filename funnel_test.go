@@ -0,0 +1,136 @@
+package main
+
+import (
+	"gopkg.in/mgo.v2/bson"
+	"reflect"
+	"testing"
+)
+
+func TestFunnelStepMatches(t *testing.T) {
+	p := &funnelParticle{
+		Event: "purchase",
+		Path:  "/checkout",
+		Data:  map[string]interface{}{"plan": "pro", "seats": int64(3)},
+	}
+
+	tests := []struct {
+		step funnelStep
+		want bool
+	}{
+		{funnelStep{Event: "purchase"}, true},
+		{funnelStep{Event: "signup"}, false},
+		{funnelStep{Event: "purchase", Path: "/checkout"}, true},
+		{funnelStep{Event: "purchase", Path: "/pricing"}, false},
+		{funnelStep{Event: "purchase", Data: map[string]string{"plan": "pro"}}, true},
+		{funnelStep{Event: "purchase", Data: map[string]string{"plan": "free"}}, false},
+		{funnelStep{Event: "purchase", Data: map[string]string{"seats": "3"}}, true},
+		{funnelStep{Event: "purchase", Data: map[string]string{"coupon": ""}}, false},
+	}
+
+	for _, test := range tests {
+		if got := test.step.matches(p); got != test.want {
+			t.Errorf("%+v matches = %v, want %v", test.step, got, test.want)
+		}
+	}
+}
+
+func TestFunnelProgress(t *testing.T) {
+	f := &funnel{
+		Steps: []funnelStep{
+			{Event: "visit", Path: "/pricing"},
+			{Event: "signup"},
+			{Event: "purchase"},
+		},
+		WindowSeconds: 100,
+		From:          1000,
+		To:            2000,
+	}
+
+	visit := func(timestamp int64) funnelParticle {
+		return funnelParticle{Timestamp: timestamp, Event: "visit", Path: "/pricing"}
+	}
+	event := func(timestamp int64, name string) funnelParticle {
+		return funnelParticle{Timestamp: timestamp, Event: name}
+	}
+
+	tests := []struct {
+		name      string
+		particles []funnelParticle
+		want      int
+	}{
+		{"none", nil, 0},
+		{"first step", []funnelParticle{visit(1000)}, 1},
+		{"every step", []funnelParticle{visit(1000), event(1010, "signup"), event(1020, "purchase")}, 3},
+		{"out of order", []funnelParticle{event(1000, "signup"), visit(1010), event(1020, "purchase")}, 1},
+		{"skipped step", []funnelParticle{visit(1000), event(1020, "purchase")}, 1},
+		{"outside the window", []funnelParticle{visit(1000), event(1050, "signup"), event(1101, "purchase")}, 2},
+		{"at the window", []funnelParticle{visit(1000), event(1050, "signup"), event(1100, "purchase")}, 3},
+		{"start before from", []funnelParticle{visit(999), event(1010, "signup")}, 0},
+		{"start at to", []funnelParticle{visit(2000), event(2010, "signup")}, 0},
+		{"steps after to", []funnelParticle{visit(1990), event(2010, "signup"), event(2020, "purchase")}, 3},
+		{"later start", []funnelParticle{visit(1000), event(1200, "signup"), visit(1300), event(1310, "signup")}, 2},
+		{"later start keeps more window", []funnelParticle{visit(1000), event(1010, "signup"), visit(1050), event(1060, "signup"), event(1140, "purchase")}, 3},
+	}
+
+	for _, test := range tests {
+		progress := newFunnelProgress(f)
+
+		for i := range test.particles {
+			progress.Add(&test.particles[i])
+		}
+
+		if progress.reached != test.want {
+			t.Errorf("%s: reached = %d, want %d", test.name, progress.reached, test.want)
+		}
+	}
+}
+
+func TestFunnelProgressRepeatedStep(t *testing.T) {
+	f := &funnel{
+		Steps:         []funnelStep{{Event: "view"}, {Event: "view"}},
+		WindowSeconds: 100,
+		From:          1000,
+		To:            2000,
+	}
+
+	tests := []struct {
+		timestamps []int64
+		want       int
+	}{
+		{[]int64{1000}, 1},
+		{[]int64{1000, 1010}, 2},
+		{[]int64{1000, 1200}, 1},
+	}
+
+	for _, test := range tests {
+		progress := newFunnelProgress(f)
+
+		for _, timestamp := range test.timestamps {
+			progress.Add(&funnelParticle{Timestamp: timestamp, Event: "view"})
+		}
+
+		if progress.reached != test.want {
+			t.Errorf("%v: reached = %d, want %d", test.timestamps, progress.reached, test.want)
+		}
+	}
+}
+
+func TestFunnelPipelineSkipsCookieless(t *testing.T) {
+	tests := []struct {
+		by    string
+		field string
+	}{
+		{funnelByBeam, "beam_id"},
+		{funnelByIdentifier, "identifier"},
+	}
+
+	for _, test := range tests {
+		f := &funnel{Steps: []funnelStep{{Event: "visit"}}, By: test.by}
+
+		match := f.pipeline()[0]["$match"].(bson.M)
+
+		if !reflect.DeepEqual(match[test.field], bson.M{"$ne": beamIdNoCookie}) {
+			t.Errorf("by %s: %s = %v", test.by, test.field, match[test.field])
+		}
+	}
+}
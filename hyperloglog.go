@@ -0,0 +1,204 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/fnv"
+	"math"
+	"math/bits"
+	"sort"
+)
+
+// 2^12 registers of one byte each.  The standard error of an estimate is
+// 1.04 / sqrt(2^12), about 1.6%.
+const (
+	hllPrecision = 12
+	hllRegisters = 1 << hllPrecision
+	hllMaxRank   = 64 - hllPrecision + 1
+)
+
+// Sketches start sparse: a sorted list of the registers that are set, as
+// index<<8 | rank, 4 bytes each.  Most dimension values ( paths, mostly ) only
+// ever see a few beams, so this keeps them small in memory and in the uniques
+// collection.  Past hllSparseMax entries - 2KB, half the dense size - a sketch
+// becomes dense.
+const hllSparseMax = 512
+
+var hllStandardError = 1.04 / math.Sqrt(hllRegisters)
+
+// A HyperLogLog sketch estimates the number of distinct values added to it.
+// Sketches merge by taking the maximum of each register, so sketches from
+// different nodes and time buckets can be combined.  registers is nil while
+// the sketch is sparse.
+type hyperLogLog struct {
+	registers []byte
+	sparse    []uint32
+}
+
+func newHyperLogLog() *hyperLogLog {
+	return &hyperLogLog{}
+}
+
+// Load a stored sketch: hllRegisters bytes if dense, otherwise its sparse
+// entries.
+func loadHyperLogLog(data []byte) (*hyperLogLog, error) {
+	h := newHyperLogLog()
+
+	if len(data) == hllRegisters {
+		h.registers = make([]byte, hllRegisters)
+		copy(h.registers, data)
+		return h, nil
+	}
+
+	if len(data)%4 != 0 || len(data)/4 > hllSparseMax {
+		return nil, errors.New("Invalid sketch size")
+	}
+
+	h.sparse = make([]uint32, len(data)/4)
+
+	for i := range h.sparse {
+		entry := binary.BigEndian.Uint32(data[i*4:])
+
+		if entry>>8 >= hllRegisters || entry&0xff == 0 || entry&0xff > hllMaxRank ||
+			(i > 0 && entry>>8 <= h.sparse[i-1]>>8) {
+			return nil, errors.New("Invalid sparse sketch")
+		}
+
+		h.sparse[i] = entry
+	}
+
+	return h, nil
+}
+
+// The sketch as it is stored; see loadHyperLogLog.
+func (h *hyperLogLog) Bytes() []byte {
+	if h.registers != nil {
+		return h.registers
+	}
+
+	data := make([]byte, len(h.sparse)*4)
+
+	for i, entry := range h.sparse {
+		binary.BigEndian.PutUint32(data[i*4:], entry)
+	}
+
+	return data
+}
+
+// Hash a value to 64 well-mixed bits.  FNV alone mixes the high bits poorly,
+// so it is finished with the MurmurHash3 finalizer.  This must never change,
+// or stored sketches can't be merged with new ones.
+func hllHash(value string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(value))
+
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+
+	return x
+}
+
+func (h *hyperLogLog) Add(value string) {
+	x := hllHash(value)
+
+	index := uint32(x >> (64 - hllPrecision))
+	rank := byte(bits.LeadingZeros64(x<<hllPrecision|1<<(hllPrecision-1)) + 1)
+
+	h.set(index, rank)
+}
+
+// Raise a register to rank.
+func (h *hyperLogLog) set(index uint32, rank byte) {
+	if h.registers != nil {
+		if rank > h.registers[index] {
+			h.registers[index] = rank
+		}
+		return
+	}
+
+	i := sort.Search(len(h.sparse), func(i int) bool {
+		return h.sparse[i]>>8 >= index
+	})
+
+	if i < len(h.sparse) && h.sparse[i]>>8 == index {
+		if uint32(rank) > h.sparse[i]&0xff {
+			h.sparse[i] = index<<8 | uint32(rank)
+		}
+		return
+	}
+
+	h.sparse = append(h.sparse, 0)
+	copy(h.sparse[i+1:], h.sparse[i:])
+	h.sparse[i] = index<<8 | uint32(rank)
+
+	if len(h.sparse) > hllSparseMax {
+		h.densify()
+	}
+}
+
+func (h *hyperLogLog) densify() {
+	h.registers = make([]byte, hllRegisters)
+
+	for _, entry := range h.sparse {
+		h.registers[entry>>8] = byte(entry & 0xff)
+	}
+
+	h.sparse = nil
+}
+
+func (h *hyperLogLog) Merge(other *hyperLogLog) {
+	if other.registers == nil {
+		for _, entry := range other.sparse {
+			h.set(entry>>8, byte(entry&0xff))
+		}
+		return
+	}
+
+	if h.registers == nil {
+		h.densify()
+	}
+
+	for i, rank := range other.registers {
+		if rank > h.registers[i] {
+			h.registers[i] = rank
+		}
+	}
+}
+
+// The estimated number of distinct values, with the small range correction.
+// A 64 bit hash doesn't need the large range one.
+func (h *hyperLogLog) Estimate() int64 {
+	m := float64(hllRegisters)
+	sum := 0.0
+	zeros := 0
+
+	if h.registers != nil {
+		for _, rank := range h.registers {
+			sum += math.Ldexp(1, -int(rank))
+
+			if rank == 0 {
+				zeros++
+			}
+		}
+	} else {
+		// Registers that aren't listed are 0.
+		zeros = hllRegisters - len(h.sparse)
+		sum = float64(zeros)
+
+		for _, entry := range h.sparse {
+			sum += math.Ldexp(1, -int(entry&0xff))
+		}
+	}
+
+	estimate := 0.7213 / (1 + 1.079/m) * m * m / sum
+
+	if estimate <= 2.5*m && zeros > 0 {
+		estimate = m * math.Log(m/float64(zeros))
+	}
+
+	return int64(estimate + 0.5)
+}
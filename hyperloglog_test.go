@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"math"
+	"strconv"
+	"testing"
+)
+
+func filledHyperLogLog(prefix string, n int) *hyperLogLog {
+	h := newHyperLogLog()
+
+	for i := 0; i < n; i++ {
+		h.Add(prefix + strconv.Itoa(i))
+	}
+
+	return h
+}
+
+func TestHyperLogLogEstimate(t *testing.T) {
+	tests := []struct {
+		n      int
+		sparse bool
+	}{
+		{0, true},
+		{10, true},
+		{100, true},
+		{1000, false},
+		{10000, false},
+		{100000, false},
+	}
+
+	for _, test := range tests {
+		h := filledHyperLogLog("beam", test.n)
+
+		if (h.registers == nil) != test.sparse {
+			t.Errorf("%d values: sparse = %v, want %v", test.n, h.registers == nil, test.sparse)
+		}
+
+		// Four standard errors; the hash is fixed, so this can't be flaky.
+		got := h.Estimate()
+		if math.Abs(float64(got-int64(test.n))) > 4*hllStandardError*float64(test.n)+1 {
+			t.Errorf("%d values: estimate %d", test.n, got)
+		}
+	}
+}
+
+func TestHyperLogLogRoundTrip(t *testing.T) {
+	for _, n := range []int{0, 50, hllSparseMax, 5000} {
+		h := filledHyperLogLog("beam", n)
+
+		loaded, err := loadHyperLogLog(h.Bytes())
+		if err != nil {
+			t.Errorf("%d values: %v", n, err)
+			continue
+		}
+
+		if !bytes.Equal(loaded.Bytes(), h.Bytes()) || loaded.Estimate() != h.Estimate() {
+			t.Errorf("%d values: loaded sketch differs", n)
+		}
+	}
+
+	if len(filledHyperLogLog("beam", 50).Bytes()) >= hllRegisters {
+		t.Errorf("sparse sketch is not smaller than a dense one")
+	}
+}
+
+func TestLoadHyperLogLogInvalid(t *testing.T) {
+	tests := [][]byte{
+		{1, 2, 3},
+		// Rank 0.
+		{0, 0, 1, 0},
+		// Index out of range.
+		{0, 0x10, 0, 1},
+		// Out of order.
+		{0, 0, 2, 1, 0, 0, 1, 1},
+		make([]byte, (hllSparseMax+1)*4),
+	}
+
+	for _, data := range tests {
+		if _, err := loadHyperLogLog(data); err == nil {
+			t.Errorf("loadHyperLogLog(%v) succeeded", data)
+		}
+	}
+}
+
+func TestHyperLogLogMerge(t *testing.T) {
+	tests := []struct {
+		a, b int
+	}{
+		{100, 100},
+		{100, 5000},
+		{5000, 100},
+		{5000, 5000},
+	}
+
+	for _, test := range tests {
+		a := filledHyperLogLog("a", test.a)
+		b := filledHyperLogLog("b", test.b)
+
+		// The merge must match adding every value to one sketch.
+		want := filledHyperLogLog("a", test.a)
+		for i := 0; i < test.b; i++ {
+			want.Add("b" + strconv.Itoa(i))
+		}
+
+		a.Merge(b)
+
+		if a.Estimate() != want.Estimate() {
+			t.Errorf("merge %d + %d: estimate %d, want %d", test.a, test.b, a.Estimate(), want.Estimate())
+		}
+	}
+}
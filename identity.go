@@ -0,0 +1,116 @@
+package main
+
+import (
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"log"
+	"strings"
+)
+
+const (
+	identityCollectionName = "identities"
+)
+
+// Everything known about an identifier, set by beam requests.  Each trait
+// keeps the time it was last written, so the latest write wins.  Times are
+// unix seconds.
+type identity struct {
+	Identifier string                   `bson:"_id" json:"identifier"`
+	Created    int64                    `bson:"created" json:"created"`
+	Updated    int64                    `bson:"updated" json:"updated"`
+	Traits     map[string]identityTrait `bson:"traits,omitempty" json:"traits,omitempty"`
+}
+
+type identityTrait struct {
+	Value   interface{} `bson:"value" json:"value"`
+	Updated int64       `bson:"updated" json:"updated"`
+}
+
+func setupIdentitiesCollection(session *mgo.Session, s *site) error {
+	sessionCopy := session.Copy()
+	defer sessionCopy.Close()
+
+	identityCollection := s.Collection(sessionCopy, identityCollectionName)
+
+	return identityCollection.EnsureIndexKey("updated")
+}
+
+// The traits in the parameters of a beam request: every key that isn't
+// reserved, typed by its key suffix.  Trait names can't contain "." or start
+// with "$".
+func identityTraits(params map[string]string) map[string]interface{} {
+	data := make(map[string]string)
+
+	for key, value := range params {
+		if !strings.HasPrefix(key, paramPrefix) {
+			data[key] = value
+		}
+	}
+
+	traits := make(map[string]interface{})
+
+	for name, value := range typeDataValues(data) {
+		if len(name) == 0 || name[0:1] == "$" || strings.Contains(name, ".") {
+			log.Printf("Invalid trait name: %s", name)
+			continue
+		}
+
+		traits[name] = value
+	}
+
+	return traits
+}
+
+// Create the identity if it doesn't exist and write its traits.  A trait is
+// only written if it hasn't been written more recently.
+func UpdateIdentity(identifier string, traits map[string]interface{}, timestamp int64, session *mgo.Session, s *site) error {
+	sessionCopy := session.Copy()
+	defer sessionCopy.Close()
+
+	identityCollection := s.Collection(sessionCopy, identityCollectionName)
+
+	_, err := identityCollection.UpsertId(identifier, bson.M{
+		"$setOnInsert": bson.M{"created": timestamp},
+		"$max":         bson.M{"updated": timestamp},
+	})
+
+	if err != nil {
+		return err
+	}
+
+	for name, value := range traits {
+		field := "traits." + name
+
+		err = identityCollection.Update(
+			bson.M{
+				"_id": identifier,
+				"$or": []bson.M{
+					{field + ".updated": bson.M{"$exists": false}},
+					{field + ".updated": bson.M{"$lte": timestamp}},
+				},
+			},
+			bson.M{"$set": bson.M{field: identityTrait{Value: value, Updated: timestamp}}})
+
+		if err != nil && err != mgo.ErrNotFound {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func GetIdentity(identifier string, session *mgo.Session, s *site) (*identity, error) {
+	sessionCopy := session.Copy()
+	defer sessionCopy.Close()
+
+	identityCollection := s.Collection(sessionCopy, identityCollectionName)
+
+	i := &identity{}
+	err := identityCollection.FindId(identifier).One(i)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return i, nil
+}
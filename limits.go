@@ -0,0 +1,221 @@
+package main
+
+import (
+	"log"
+	"sort"
+	"sync"
+	"unicode/utf8"
+)
+
+const (
+	defaultMaxKeyLength   = 255
+	defaultMaxValueLength = 255
+	defaultMaxKeys        = 100
+	defaultMaxRequestSize = 65536
+)
+
+// What happens to parameters over a limit.
+const (
+	limitActionTruncate = "truncate"
+	limitActionReject   = "reject"
+)
+
+// The most percent-encoded characters the client puts in one part of a
+// request; see __requestCharLimit in client/tetryon.js.
+const clientRequestChunkSize = 2000
+
+// Limits, as they are counted.
+const (
+	limitKeyLength   = "key_length"
+	limitValueLength = "value_length"
+	limitKeys        = "keys"
+	limitRequestSize = "request_size"
+	// Data keys that can't be nested; see nestData.
+	limitDataKey = "data_key"
+)
+
+// Enforces limits on reassembled requests.  While a request is reassembled
+// only its size is limited; the other limits are checked once every part has
+// arrived ( and its signature checked ), so they apply to the request as a
+// whole.
+type paramLimits struct {
+	config LimitsConfig
+	counts map[string]int64
+	mutex  sync.Mutex
+}
+
+func loadParamLimits(limitsConfig LimitsConfig) *paramLimits {
+	return &paramLimits{
+		config: limitsConfig,
+		counts: make(map[string]int64),
+	}
+}
+
+func (l *paramLimits) count(limit string) {
+	l.mutex.Lock()
+	l.counts[limit+":"+l.config.Action]++
+	l.mutex.Unlock()
+}
+
+// Check the parameters of a reassembled request, truncating them in place
+// if configured to.  Lengths are in characters.  Returns false if the request
+// must be rejected.
+func (l *paramLimits) CheckParams(params map[string]string) bool {
+	keys := make([]string, 0, len(params))
+	for key := range params {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		// Parameters added by the server aren't limited, and truncating the
+		// request ID would break reassembly.
+		if unsignedParams[key] {
+			continue
+		}
+
+		value := params[key]
+
+		if utf8.RuneCountInString(value) > l.config.MaxValueLength {
+			l.count(limitValueLength)
+
+			if l.config.Action == limitActionReject {
+				return false
+			}
+
+			value = truncateRunes(value, l.config.MaxValueLength)
+			params[key] = value
+		}
+
+		// Reserved keys can't be truncated without losing their meaning.
+		if !reservedParam(key) &&
+			utf8.RuneCountInString(key) > l.config.MaxKeyLength {
+			l.count(limitKeyLength)
+
+			if l.config.Action == limitActionReject {
+				return false
+			}
+
+			delete(params, key)
+
+			// A truncated key never replaces one that was sent; keys are in
+			// sorted order, so the first long key to truncate onto another
+			// wins.
+			truncated := truncateRunes(key, l.config.MaxKeyLength)
+
+			if _, exists := params[truncated]; !exists {
+				params[truncated] = value
+			}
+		}
+	}
+
+	dataKeys := 0
+
+	for key := range params {
+		if !reservedParam(key) {
+			dataKeys++
+		}
+	}
+
+	if dataKeys > l.config.MaxKeys {
+		l.count(limitKeys)
+
+		if l.config.Action == limitActionReject {
+			return false
+		}
+
+		l.truncateKeys(params, l.config.MaxKeys)
+	}
+
+	return true
+}
+
+// The first max characters of s.
+func truncateRunes(s string, max int) string {
+	runes := 0
+
+	for i := range s {
+		if runes == max {
+			return s[:i]
+		}
+		runes++
+	}
+
+	return s
+}
+
+// Keep the first max data keys, in sorted order so the result is stable.
+func (l *paramLimits) truncateKeys(params map[string]string, max int) {
+	var dataKeys []string
+
+	for key := range params {
+		if !reservedParam(key) {
+			dataKeys = append(dataKeys, key)
+		}
+	}
+
+	sort.Strings(dataKeys)
+
+	for _, key := range dataKeys[max:] {
+		delete(params, key)
+	}
+}
+
+// The most parts a request can be split into.  Any two consecutive parts the
+// client sends hold more than clientRequestChunkSize encoded characters, and
+// so more than a third of that in bytes, which bounds the parts needed to
+// send max_request_size bytes.
+func (l *paramLimits) MaxParts() int {
+	return 2*l.config.MaxRequestSize/(clientRequestChunkSize/3) + 2
+}
+
+// Whether a part can be added to a reassembled request without taking it
+// over max_request_size ( in bytes ).  Returns the parameters that can be
+// added, and false if the request must be rejected.
+func (l *paramLimits) CheckRequest(r *request, params map[string]string) (map[string]string, bool) {
+	size := r.Size
+
+	accepted := make(map[string]string)
+
+	keys := make([]string, 0, len(params))
+	for key := range params {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		value := params[key]
+
+		// Reserved keys are always accepted; the request can't be handled
+		// without them.
+		if !reservedParam(key) &&
+			size+len(key)+len(value) > l.config.MaxRequestSize {
+			l.count(limitRequestSize)
+
+			if l.config.Action == limitActionReject {
+				return nil, false
+			}
+			continue
+		}
+
+		size += len(key) + len(value)
+		accepted[key] = value
+	}
+
+	return accepted, true
+}
+
+func logParamLimits(l *paramLimits) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	limits := make([]string, 0, len(l.counts))
+	for limit := range l.counts {
+		limits = append(limits, limit)
+	}
+	sort.Strings(limits)
+
+	for _, limit := range limits {
+		log.Printf("Requests over limit ( %s ): %d", limit, l.counts[limit])
+	}
+}
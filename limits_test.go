@@ -0,0 +1,200 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func testLimits(action string) *paramLimits {
+	return loadParamLimits(LimitsConfig{
+		MaxKeyLength:   4,
+		MaxValueLength: 4,
+		MaxKeys:        3,
+		MaxRequestSize: 64,
+		Action:         action,
+	})
+}
+
+func TestTruncateRunes(t *testing.T) {
+	tests := []struct {
+		s    string
+		max  int
+		want string
+	}{
+		{"abcdef", 4, "abcd"},
+		{"abc", 4, "abc"},
+		{"", 4, ""},
+		{"héllo", 2, "hé"},
+		{"日本語テキスト", 3, "日本語"},
+		{"abc", 0, ""},
+	}
+
+	for _, test := range tests {
+		if got := truncateRunes(test.s, test.max); got != test.want {
+			t.Errorf("truncateRunes(%q, %d) = %q, want %q", test.s, test.max, got, test.want)
+		}
+	}
+}
+
+func TestCheckParams(t *testing.T) {
+	tests := []struct {
+		name   string
+		action string
+		params map[string]string
+		ok     bool
+		want   map[string]string
+	}{
+		{
+			name:   "within limits",
+			action: limitActionTruncate,
+			params: map[string]string{"a": "1", "b": "2"},
+			ok:     true,
+			want:   map[string]string{"a": "1", "b": "2"},
+		},
+		{
+			name:   "characters, not bytes",
+			action: limitActionTruncate,
+			params: map[string]string{"ключ": "日本語テ"},
+			ok:     true,
+			want:   map[string]string{"ключ": "日本語テ"},
+		},
+		{
+			name:   "long value truncated on a rune boundary",
+			action: limitActionTruncate,
+			params: map[string]string{"a": "日本語テキスト"},
+			ok:     true,
+			want:   map[string]string{"a": "日本語テ"},
+		},
+		{
+			name:   "long key truncated",
+			action: limitActionTruncate,
+			params: map[string]string{"abcdef": "1"},
+			ok:     true,
+			want:   map[string]string{"abcd": "1"},
+		},
+		{
+			name:   "long key never replaces a sent key",
+			action: limitActionTruncate,
+			params: map[string]string{"abcd": "1", "abcdef": "2"},
+			ok:     true,
+			want:   map[string]string{"abcd": "1"},
+		},
+		{
+			name:   "first long key wins",
+			action: limitActionTruncate,
+			params: map[string]string{"abcdef": "1", "abcdxy": "2"},
+			ok:     true,
+			want:   map[string]string{"abcd": "1"},
+		},
+		{
+			name:   "extra keys dropped in sorted order",
+			action: limitActionTruncate,
+			params: map[string]string{"d": "4", "c": "3", "b": "2", "a": "1", paramEvent: "buy"},
+			ok:     true,
+			want:   map[string]string{"a": "1", "b": "2", "c": "3", paramEvent: "buy"},
+		},
+		{
+			name:   "server parameters are not limited",
+			action: limitActionTruncate,
+			params: map[string]string{paramUserAgent: "Mozilla/5.0", paramRequestId: "abcdef:1-1"},
+			ok:     true,
+			want:   map[string]string{paramUserAgent: "Mozilla/5.0", paramRequestId: "abcdef:1-1"},
+		},
+		{
+			name:   "unknown reserved keys are limited",
+			action: limitActionTruncate,
+			params: map[string]string{"_ttynFooBar": "1", "a": "1", "b": "2", "c": "3"},
+			ok:     true,
+			want:   map[string]string{"_tty": "1", "a": "1", "b": "2"},
+		},
+		{
+			name:   "unknown reserved keys rejected",
+			action: limitActionReject,
+			params: map[string]string{"_ttynX": "1", "a": "1", "b": "2", "c": "3"},
+			ok:     false,
+		},
+		{
+			name:   "long value rejected",
+			action: limitActionReject,
+			params: map[string]string{"a": "abcdef"},
+			ok:     false,
+		},
+		{
+			name:   "long key rejected",
+			action: limitActionReject,
+			params: map[string]string{"abcdef": "1"},
+			ok:     false,
+		},
+		{
+			name:   "too many keys rejected",
+			action: limitActionReject,
+			params: map[string]string{"a": "1", "b": "2", "c": "3", "d": "4"},
+			ok:     false,
+		},
+	}
+
+	for _, test := range tests {
+		ok := testLimits(test.action).CheckParams(test.params)
+
+		if ok != test.ok {
+			t.Errorf("%s: CheckParams = %v, want %v", test.name, ok, test.ok)
+			continue
+		}
+
+		if ok && !reflect.DeepEqual(test.params, test.want) {
+			t.Errorf("%s: params = %v, want %v", test.name, test.params, test.want)
+		}
+	}
+}
+
+func TestCheckRequest(t *testing.T) {
+	l := testLimits(limitActionTruncate)
+	r := &request{Parameters: map[string]string{}, Size: 60}
+
+	accepted, ok := l.CheckRequest(r, map[string]string{
+		"a":            strings.Repeat("x", 10),
+		"_ttynPadding": strings.Repeat("x", 10),
+		paramEvent:     "visit",
+		paramBeamId:    "beam",
+	})
+
+	if !ok {
+		t.Fatal("CheckRequest rejected a request in truncate mode")
+	}
+
+	if _, ok := accepted["a"]; ok {
+		t.Error("data key over max_request_size was accepted")
+	}
+
+	if _, ok := accepted["_ttynPadding"]; ok {
+		t.Error("unknown reserved key over max_request_size was accepted")
+	}
+
+	if _, ok := accepted[paramEvent]; !ok {
+		t.Error("reserved key was not accepted")
+	}
+
+	if _, ok := testLimits(limitActionReject).CheckRequest(r, map[string]string{"a": strings.Repeat("x", 10)}); ok {
+		t.Error("CheckRequest accepted a request over max_request_size in reject mode")
+	}
+}
+
+func TestMaxParts(t *testing.T) {
+	tests := []struct {
+		maxRequestSize int
+		want           int
+	}{
+		{65536, 198},
+		{666, 4},
+		{1, 2},
+	}
+
+	for _, test := range tests {
+		l := loadParamLimits(LimitsConfig{MaxRequestSize: test.maxRequestSize})
+
+		if got := l.MaxParts(); got != test.want {
+			t.Errorf("MaxParts() with max_request_size %d = %d, want %d", test.maxRequestSize, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,419 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	linkTokenCollectionName = "link_tokens"
+)
+
+const defaultLinkTokenTtlSeconds = 120
+
+// Proof cookies are named for their beam, so a browser can hold one for each
+// of its beams.
+const (
+	linkProofCookiePrefix     = paramPrefix + "LinkProof"
+	linkProofCookieMaxAgeDays = 365
+)
+
+// Carries a link token from one domain to another, i.e.
+// https://other-domain.com/?_ttynLink=<token>
+const paramLinkToken = paramPrefix + "Link"
+
+// Beam IDs generated by the client are 52 random characters followed by a
+// 12 character timestamp.  Only those can be linked.
+var beamIdPattern = regexp.MustCompile("^[a-zA-Z0-9]{64}$")
+
+// Issues and redeems tokens that carry a beam from one domain to another.
+// A token is the site, beam ID, expiry and a nonce, signed with the linking
+// secret.  The nonce is kept until the token is redeemed ( or expires ), so
+// each token can only be redeemed once.
+type beamLinker struct {
+	secret      []byte
+	ttl         time.Duration
+	saveToken   func(session *mgo.Session, s *site, t linkToken) error
+	removeToken func(session *mgo.Session, s *site, nonce string) error
+}
+
+// An issued token that hasn't been redeemed.  Expired tokens are removed by a
+// TTL index.
+type linkToken struct {
+	Nonce     string    `bson:"_id"`
+	BeamId    string    `bson:"beam_id"`
+	ExpiresAt time.Time `bson:"expires_at"`
+}
+
+type linkResponse struct {
+	Token   string `json:"token,omitempty"`
+	Expires int64  `json:"expires,omitempty"`
+	Linked  bool   `json:"linked,omitempty"`
+}
+
+func loadBeamLinker(linkingConfig LinkingConfig) *beamLinker {
+	ttl := linkingConfig.TokenTtlSeconds
+	if ttl <= 0 {
+		ttl = defaultLinkTokenTtlSeconds
+	}
+
+	return &beamLinker{
+		secret:      []byte(linkingConfig.Secret),
+		ttl:         time.Duration(ttl) * time.Second,
+		saveToken:   saveLinkToken,
+		removeToken: removeLinkToken,
+	}
+}
+
+func (l *beamLinker) sign(payload string) string {
+	mac := hmac.New(sha256.New, l.secret)
+	mac.Write([]byte(payload))
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func setupLinkTokensCollection(session *mgo.Session, s *site) error {
+	sessionCopy := session.Copy()
+	defer sessionCopy.Close()
+
+	linkTokenCollection := s.Collection(sessionCopy, linkTokenCollectionName)
+
+	return linkTokenCollection.EnsureIndex(mgo.Index{
+		Key:         []string{"expires_at"},
+		ExpireAfter: time.Second,
+	})
+}
+
+func saveLinkToken(session *mgo.Session, s *site, t linkToken) error {
+	sessionCopy := session.Copy()
+	defer sessionCopy.Close()
+
+	linkTokenCollection := s.Collection(sessionCopy, linkTokenCollectionName)
+
+	return linkTokenCollection.Insert(t)
+}
+
+// Returns mgo.ErrNotFound if the token was already removed.  Removing is
+// atomic, so only one redeem can succeed.
+func removeLinkToken(session *mgo.Session, s *site, nonce string) error {
+	sessionCopy := session.Copy()
+	defer sessionCopy.Close()
+
+	linkTokenCollection := s.Collection(sessionCopy, linkTokenCollectionName)
+
+	return linkTokenCollection.RemoveId(nonce)
+}
+
+// Issue a token for a beam.  Returns the token and when it expires.
+func (l *beamLinker) Issue(session *mgo.Session, s *site, beamId string, now time.Time) (string, int64, error) {
+	nonceData := make([]byte, 16)
+
+	if _, err := rand.Read(nonceData); err != nil {
+		return "", 0, err
+	}
+
+	nonce := hex.EncodeToString(nonceData)
+	expiresAt := now.Add(l.ttl)
+
+	err := l.saveToken(session, s, linkToken{Nonce: nonce, BeamId: beamId, ExpiresAt: expiresAt.UTC()})
+	if err != nil {
+		return "", 0, err
+	}
+
+	expires := expiresAt.Unix()
+	payload := s.Id + ":" + beamId + ":" + strconv.FormatInt(expires, 10) + ":" + nonce
+
+	return base64.RawURLEncoding.EncodeToString([]byte(payload)) + "." + l.sign(payload), expires, nil
+}
+
+// Check a token was issued by this linker for the site and hasn't expired.
+// Returns the beam ID and nonce it was issued with.
+func (l *beamLinker) verify(siteId string, token string, now time.Time) (string, string, bool) {
+	parts := strings.Split(token, ".")
+
+	if len(parts) != 2 {
+		return "", "", false
+	}
+
+	payloadData, err := base64.RawURLEncoding.DecodeString(parts[0])
+
+	if err != nil {
+		return "", "", false
+	}
+
+	payload := string(payloadData)
+
+	if !hmac.Equal([]byte(l.sign(payload)), []byte(parts[1])) {
+		return "", "", false
+	}
+
+	fields := strings.Split(payload, ":")
+
+	if len(fields) != 4 || fields[0] != siteId {
+		return "", "", false
+	}
+
+	expires, err := strconv.ParseInt(fields[2], 10, 64)
+
+	if err != nil || now.Unix() > expires {
+		return "", "", false
+	}
+
+	return fields[1], fields[3], true
+}
+
+// Redeem a token issued for the site.  Returns the beam ID it was issued
+// for, and false if it is invalid, expired or has already been redeemed.
+func (l *beamLinker) Redeem(session *mgo.Session, s *site, token string, now time.Time) (string, bool, error) {
+	beamId, nonce, ok := l.verify(s.Id, token, now)
+
+	if !ok {
+		return "", false, nil
+	}
+
+	err := l.removeToken(session, s, nonce)
+
+	if err == mgo.ErrNotFound {
+		return "", false, nil
+	}
+
+	if err != nil {
+		return "", false, err
+	}
+
+	return beamId, true, nil
+}
+
+// The value of the proof cookie for a beam.
+func (l *beamLinker) proof(siteId string, beamId string) string {
+	return l.sign("proof:" + siteId + ":" + beamId)
+}
+
+// Whether the client owns the beam it sent.  The beam cookie belongs to the
+// site's domain, so Tetryon can't read it; instead the first client to use a
+// beam with /link is given an HttpOnly proof cookie for it, and only clients
+// with that cookie can use the beam afterwards.
+func (l *beamLinker) Owns(w http.ResponseWriter, r *http.Request, session *mgo.Session, s *site, beamId string) (bool, error) {
+	expected := l.proof(s.Id, beamId)
+
+	if cookie, err := r.Cookie(linkProofCookiePrefix + beamId); err == nil {
+		return hmac.Equal([]byte(cookie.Value), []byte(expected)), nil
+	}
+
+	b, err := GetBeamById(beamId, session, s)
+
+	if err != nil {
+		return false, err
+	}
+
+	sessionCopy := session.Copy()
+	defer sessionCopy.Close()
+
+	beamCollection := s.Collection(sessionCopy, beamCollectionName)
+
+	// Only the first client to claim the beam is bound to it.
+	err = beamCollection.Update(
+		bson.M{"_id": b.Id, "link_bound": bson.M{"$ne": true}},
+		bson.M{"$set": bson.M{"link_bound": true}})
+
+	if err == mgo.ErrNotFound {
+		return false, nil
+	}
+
+	if err != nil {
+		return false, err
+	}
+
+	cookie := &http.Cookie{
+		Name:     linkProofCookiePrefix + beamId,
+		Value:    expected,
+		Path:     "/",
+		MaxAge:   linkProofCookieMaxAgeDays * 86400,
+		HttpOnly: true,
+		// The cookie is sent from the site's pages, so it must be a third
+		// party cookie - which browsers only allow with these, over HTTPS.
+		Secure:   true,
+		SameSite: http.SameSiteNoneMode,
+	}
+
+	http.SetCookie(w, cookie)
+
+	return true, nil
+}
+
+// Link two beams of the same user, giving them the same identifier ( the
+// way a beam request does ).  An identified beam's identifier wins over an
+// anonymous one; otherwise the source beam's is used.  Each beam records the
+// other in linked_beams.
+func LinkBeams(sourceBeamId string, beamId string, session *mgo.Session, s *site) (string, error) {
+	source, err := GetBeamById(sourceBeamId, session, s)
+
+	if err != nil {
+		return "", err
+	}
+
+	b, err := GetBeamById(beamId, session, s)
+
+	if err != nil {
+		return "", err
+	}
+
+	identifier := source.Identifier
+	if identifier == source.BeamId && b.Identifier != b.BeamId {
+		identifier = b.Identifier
+	}
+
+	params := map[string]string{paramBeamIdentifier: identifier}
+
+	for _, linked := range []*beam{source, b} {
+		if err = linked.Update(params, session, s); err != nil {
+			return "", err
+		}
+	}
+
+	sessionCopy := session.Copy()
+	defer sessionCopy.Close()
+
+	beamCollection := s.Collection(sessionCopy, beamCollectionName)
+
+	err = beamCollection.UpdateId(source.Id, bson.M{"$addToSet": bson.M{"linked_beams": b.BeamId}})
+	if err != nil {
+		return "", err
+	}
+
+	err = beamCollection.UpdateId(b.Id, bson.M{"$addToSet": bson.M{"linked_beams": source.BeamId}})
+	if err != nil {
+		return "", err
+	}
+
+	return identifier, nil
+}
+
+// GET /link?_ttynBeam=<beam>
+// Issues a token for the beam.
+//
+// GET /link?_ttynLink=<token>&_ttynBeam=<beam>
+// Redeems a token, linking the beam to the token's beam.  The token's beam ID
+// is never sent back.
+//
+// Either way the client must own the beam it sends ( see Owns ), and other
+// origins must be listed in the site's domains.  Only HTTPS requests are
+// served, as the proof cookie can't be sent without it.
+func handleLinkRequest(session *mgo.Session, sites *siteRouter, linker *beamLinker) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			writeJsonError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+
+		if r.TLS == nil {
+			writeJsonError(w, http.StatusForbidden, "https required")
+			return
+		}
+
+		if r.ParseForm() != nil {
+			writeJsonError(w, http.StatusBadRequest, "could not parse form")
+			return
+		}
+
+		params := formParams(r.Form)
+
+		s, ok := sites.Route(r, params)
+
+		if !ok {
+			writeJsonError(w, http.StatusForbidden, "unknown site")
+			return
+		}
+
+		// The token is read from other domains, so they need CORS - with
+		// credentials, for the proof cookie.  Only origins the site lists are
+		// allowed, even if its list is empty.
+		if origin := requestOrigin(r); len(origin) > 0 && len(r.Header.Get("Origin")) > 0 {
+			if !s.domains.Matches(origin) {
+				writeJsonError(w, http.StatusForbidden, "origin not allowed")
+				return
+			}
+
+			w.Header().Set("Access-Control-Allow-Origin", r.Header.Get("Origin"))
+			w.Header().Set("Access-Control-Allow-Credentials", "true")
+			w.Header().Set("Vary", "Origin")
+		}
+
+		beamId, hasBeam := params[paramBeamId]
+
+		if !hasBeam {
+			writeJsonError(w, http.StatusBadRequest, "missing "+paramBeamId)
+			return
+		}
+
+		if !beamIdPattern.MatchString(beamId) {
+			writeJsonError(w, http.StatusBadRequest, "invalid beam")
+			return
+		}
+
+		owns, err := linker.Owns(w, r, session, s, beamId)
+
+		if err != nil {
+			log.Println(err)
+			writeJsonError(w, http.StatusInternalServerError, "could not check beam")
+			return
+		}
+
+		if !owns {
+			writeJsonError(w, http.StatusForbidden, "beam not owned by client")
+			return
+		}
+
+		token, hasToken := params[paramLinkToken]
+
+		if !hasToken {
+			token, expires, err := linker.Issue(session, s, beamId, time.Now())
+
+			if err != nil {
+				log.Println(err)
+				writeJsonError(w, http.StatusInternalServerError, "could not issue token")
+				return
+			}
+
+			writeJson(w, http.StatusOK, linkResponse{Token: token, Expires: expires})
+			return
+		}
+
+		sourceBeamId, ok, err := linker.Redeem(session, s, token, time.Now())
+
+		if err != nil {
+			log.Println(err)
+			writeJsonError(w, http.StatusInternalServerError, "could not redeem token")
+			return
+		}
+
+		if !ok {
+			writeJsonError(w, http.StatusForbidden, "invalid, expired or redeemed token")
+			return
+		}
+
+		if beamId == sourceBeamId {
+			writeJson(w, http.StatusOK, linkResponse{Linked: true})
+			return
+		}
+
+		if _, err = LinkBeams(sourceBeamId, beamId, session, s); err != nil {
+			log.Println(err)
+			writeJsonError(w, http.StatusInternalServerError, "could not link beams")
+			return
+		}
+
+		writeJson(w, http.StatusOK, linkResponse{Linked: true})
+	}
+}
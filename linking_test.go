@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/base64"
+	"gopkg.in/mgo.v2"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestLinkTokenVerify(t *testing.T) {
+	l := loadBeamLinker(LinkingConfig{Secret: "secret"})
+	now := time.Now()
+
+	token := func(siteId string, expires time.Time, nonce string) string {
+		payload := siteId + ":beam:" + strconv.FormatInt(expires.Unix(), 10) + ":" + nonce
+		return base64.RawURLEncoding.EncodeToString([]byte(payload)) + "." + l.sign(payload)
+	}
+
+	valid := token("shop", now.Add(time.Minute), "n1")
+
+	tests := []struct {
+		name  string
+		token string
+		site  string
+		ok    bool
+	}{
+		{"valid", valid, "shop", true},
+		{"other site", valid, "blog", false},
+		{"expired", token("shop", now.Add(-time.Minute), "n1"), "shop", false},
+		{"tampered", valid + "0", "shop", false},
+		{"other secret", func() string {
+			other := loadBeamLinker(LinkingConfig{Secret: "other"})
+			payload := "shop:beam:" + strconv.FormatInt(now.Add(time.Minute).Unix(), 10) + ":n1"
+			return base64.RawURLEncoding.EncodeToString([]byte(payload)) + "." + other.sign(payload)
+		}(), "shop", false},
+		{"no nonce", func() string {
+			payload := "shop:beam:" + strconv.FormatInt(now.Add(time.Minute).Unix(), 10)
+			return base64.RawURLEncoding.EncodeToString([]byte(payload)) + "." + l.sign(payload)
+		}(), "shop", false},
+		{"malformed", "not-a-token", "shop", false},
+	}
+
+	for _, test := range tests {
+		beamId, nonce, ok := l.verify(test.site, test.token, now)
+
+		if ok != test.ok {
+			t.Errorf("%s: verify = %v, want %v", test.name, ok, test.ok)
+			continue
+		}
+
+		if ok && (beamId != "beam" || nonce != "n1") {
+			t.Errorf("%s: verify = %q, %q, want beam, n1", test.name, beamId, nonce)
+		}
+	}
+}
+
+func TestLinkProof(t *testing.T) {
+	l := loadBeamLinker(LinkingConfig{Secret: "secret"})
+
+	if l.proof("shop", "a") == l.proof("shop", "b") || l.proof("shop", "a") == l.proof("blog", "a") {
+		t.Error("proofs for different beams or sites are the same")
+	}
+}
+
+// A linker that keeps its tokens in memory, the way the collection would.
+func testBeamLinker() *beamLinker {
+	l := loadBeamLinker(LinkingConfig{Secret: "secret"})
+	tokens := make(map[string]linkToken)
+
+	l.saveToken = func(session *mgo.Session, s *site, t linkToken) error {
+		tokens[s.Id+":"+t.Nonce] = t
+		return nil
+	}
+
+	l.removeToken = func(session *mgo.Session, s *site, nonce string) error {
+		if _, ok := tokens[s.Id+":"+nonce]; !ok {
+			return mgo.ErrNotFound
+		}
+
+		delete(tokens, s.Id+":"+nonce)
+		return nil
+	}
+
+	return l
+}
+
+func TestLinkTokenRedeemOnce(t *testing.T) {
+	l := testBeamLinker()
+	s := &site{Id: "shop"}
+	now := time.Now()
+
+	token, _, err := l.Issue(nil, s, "beam", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if beamId, ok, err := l.Redeem(nil, s, token, now); err != nil || !ok || beamId != "beam" {
+		t.Errorf("first redeem = %q, %v, %v, want beam, true", beamId, ok, err)
+	}
+
+	if _, ok, err := l.Redeem(nil, s, token, now); err != nil || ok {
+		t.Errorf("second redeem = %v, %v, want false", ok, err)
+	}
+}
+
+func TestLinkTokenRedeemExpired(t *testing.T) {
+	l := testBeamLinker()
+	s := &site{Id: "shop"}
+	now := time.Now()
+
+	token, _, err := l.Issue(nil, s, "beam", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok, err := l.Redeem(nil, s, token, now.Add(l.ttl+time.Second)); err != nil || ok {
+		t.Errorf("expired redeem = %v, %v, want false", ok, err)
+	}
+
+	// An expired redeem doesn't use the token up.
+	if _, ok, _ := l.Redeem(nil, s, token, now); !ok {
+		t.Error("token was removed by an expired redeem")
+	}
+}
+
+func TestLinkOwnsProofCookie(t *testing.T) {
+	l := testBeamLinker()
+	s := &site{Id: "shop"}
+
+	tests := []struct {
+		name  string
+		value string
+		owns  bool
+	}{
+		{"proof", l.proof("shop", "beam"), true},
+		{"other beam", l.proof("shop", "other"), false},
+		{"other site", l.proof("blog", "beam"), false},
+		{"forged", "0000", false},
+	}
+
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "https://tetryon.example.com/link", nil)
+		r.AddCookie(&http.Cookie{Name: linkProofCookiePrefix + "beam", Value: test.value})
+
+		// A client with a proof cookie is checked without the database.
+		owns, err := l.Owns(httptest.NewRecorder(), r, nil, s, "beam")
+
+		if err != nil || owns != test.owns {
+			t.Errorf("%s: owns = %v, %v, want %v", test.name, owns, err, test.owns)
+		}
+	}
+}
+
+func TestLinkRequestRequiresHttps(t *testing.T) {
+	handler := handleLinkRequest(nil, &siteRouter{}, testBeamLinker())
+
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest("GET", "http://tetryon.example.com/link?_ttynBeam=beam", nil))
+
+	if w.Code != http.StatusForbidden {
+		t.Errorf("status = %d, want 403", w.Code)
+	}
+}
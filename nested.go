@@ -0,0 +1,179 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	defaultMaxDataDepth       = 5
+	defaultMaxDataArrayLength = 100
+)
+
+// Parse a data key into its path, i.e. "items[0].sku" is
+// []interface{}{"items", 0, "sku"}.  Names are strings and indexes are ints.
+func parseDataPath(key string) ([]interface{}, error) {
+	var path []interface{}
+
+	for _, part := range strings.Split(key, ".") {
+		name := part
+		indexes := ""
+
+		if i := strings.Index(part, "["); i >= 0 {
+			name = part[:i]
+			indexes = part[i:]
+		}
+
+		if len(name) == 0 || name[0:1] == "$" {
+			return nil, fmt.Errorf("Invalid data key: %s", key)
+		}
+
+		path = append(path, name)
+
+		for len(indexes) > 0 {
+			end := strings.Index(indexes, "]")
+
+			if indexes[0:1] != "[" || end < 0 {
+				return nil, fmt.Errorf("Invalid data key: %s", key)
+			}
+
+			index, err := strconv.Atoi(indexes[1:end])
+
+			if err != nil || index < 0 {
+				return nil, fmt.Errorf("Invalid data key: %s", key)
+			}
+
+			path = append(path, index)
+			indexes = indexes[end+1:]
+		}
+	}
+
+	return path, nil
+}
+
+// Expand flat data keys into nested documents and arrays.  Keys that are
+// invalid, too deep or conflict with a key before them ( in sorted order, so
+// the same keys always give the same result ) are left out, and returned
+// with the reason.
+func nestData(flat map[string]interface{}, limits LimitsConfig) (map[string]interface{}, []error) {
+	var dropped []error
+
+	keys := make([]string, 0, len(flat))
+	for key := range flat {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	nested := make(map[string]interface{})
+
+	for _, key := range keys {
+		value := flat[key]
+
+		if !strings.ContainsAny(key, ".[$") {
+			if _, ok := nested[key]; ok {
+				dropped = append(dropped, fmt.Errorf("Conflicting data key: %s", key))
+				continue
+			}
+			nested[key] = value
+			continue
+		}
+
+		path, err := parseDataPath(key)
+
+		if err != nil {
+			dropped = append(dropped, err)
+			continue
+		}
+
+		if len(path) > limits.MaxDepth {
+			dropped = append(dropped, fmt.Errorf("Data key too deep: %s", key))
+			continue
+		}
+
+		if _, err = setDataPath(nested, path, value, limits); err != nil {
+			dropped = append(dropped, fmt.Errorf("%s: %s", err, key))
+		}
+	}
+
+	return nested, dropped
+}
+
+// Set value at path within container, creating documents and arrays as
+// needed.  Returns the container, which is new if it was nil.
+func setDataPath(container interface{}, path []interface{}, value interface{}, limits LimitsConfig) (interface{}, error) {
+	if len(path) == 0 {
+		if container != nil {
+			return nil, fmt.Errorf("Conflicting data key")
+		}
+		return value, nil
+	}
+
+	switch segment := path[0].(type) {
+	case string:
+		document, ok := container.(map[string]interface{})
+
+		if container == nil {
+			document = make(map[string]interface{})
+		} else if !ok {
+			return nil, fmt.Errorf("Conflicting data key")
+		}
+
+		child, err := setDataPath(document[segment], path[1:], value, limits)
+
+		if err != nil {
+			return nil, err
+		}
+
+		document[segment] = child
+
+		return document, nil
+	case int:
+		array, ok := container.([]interface{})
+
+		if container != nil && !ok {
+			return nil, fmt.Errorf("Conflicting data key")
+		}
+
+		if segment >= limits.MaxArrayLength {
+			return nil, fmt.Errorf("Data array too long")
+		}
+
+		for len(array) <= segment {
+			array = append(array, nil)
+		}
+
+		child, err := setDataPath(array[segment], path[1:], value, limits)
+
+		if err != nil {
+			return nil, err
+		}
+
+		array[segment] = child
+
+		return array, nil
+	}
+
+	return nil, fmt.Errorf("Invalid data path")
+}
+
+// Read all values for a form key.  Repeated keys are given indexes so they
+// are stored as an array, i.e. "tags=a&tags=b" becomes tags[0] and tags[1].
+// Reserved keys only ever take their first value.
+func formParams(form map[string][]string) map[string]string {
+	params := make(map[string]string)
+
+	for key, values := range form {
+		if len(values) == 1 || strings.HasPrefix(key, paramPrefix) {
+			params[key] = values[0]
+			continue
+		}
+
+		for i, value := range values {
+			params[key+"["+strconv.Itoa(i)+"]"] = value
+		}
+	}
+
+	return params
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+var testDataLimits = LimitsConfig{MaxDepth: 3, MaxArrayLength: 10}
+
+func TestParseDataPath(t *testing.T) {
+	tests := []struct {
+		key  string
+		want []interface{}
+	}{
+		{"sku", []interface{}{"sku"}},
+		{"cart.total", []interface{}{"cart", "total"}},
+		{"items[0].sku", []interface{}{"items", 0, "sku"}},
+		{"grid[1][2]", []interface{}{"grid", 1, 2}},
+		{"a..b", nil},
+		{"$where", nil},
+		{"items[x]", nil},
+		{"items[-1]", nil},
+		{"items[0", nil},
+		{"[0]", nil},
+	}
+
+	for _, test := range tests {
+		path, err := parseDataPath(test.key)
+
+		if test.want == nil {
+			if err == nil {
+				t.Errorf("parseDataPath(%q) = %v, want an error", test.key, path)
+			}
+			continue
+		}
+
+		if err != nil || !reflect.DeepEqual(path, test.want) {
+			t.Errorf("parseDataPath(%q) = %v, %v, want %v", test.key, path, err, test.want)
+		}
+	}
+}
+
+func TestNestData(t *testing.T) {
+	tests := []struct {
+		name    string
+		flat    map[string]interface{}
+		want    map[string]interface{}
+		dropped int
+	}{
+		{
+			name: "flat",
+			flat: map[string]interface{}{"a": "1", "b": int64(2)},
+			want: map[string]interface{}{"a": "1", "b": int64(2)},
+		},
+		{
+			name: "documents and arrays",
+			flat: map[string]interface{}{
+				"cart.total":     19.99,
+				"items[0].sku":   "LEP-5000",
+				"items[1].sku":   "LEP-6000",
+				"items[1].count": int64(2),
+			},
+			want: map[string]interface{}{
+				"cart": map[string]interface{}{"total": 19.99},
+				"items": []interface{}{
+					map[string]interface{}{"sku": "LEP-5000"},
+					map[string]interface{}{"sku": "LEP-6000", "count": int64(2)},
+				},
+			},
+		},
+		{
+			name:    "conflict keeps the first key in sorted order",
+			flat:    map[string]interface{}{"a": "1", "a.b": "2", "c": "3"},
+			want:    map[string]interface{}{"a": "1", "c": "3"},
+			dropped: 1,
+		},
+		{
+			name:    "document and array conflict",
+			flat:    map[string]interface{}{"a.b": "1", "a[0]": "2"},
+			want:    map[string]interface{}{"a": map[string]interface{}{"b": "1"}},
+			dropped: 1,
+		},
+		{
+			name:    "too deep",
+			flat:    map[string]interface{}{"a.b.c.d": "1", "e": "2"},
+			want:    map[string]interface{}{"e": "2"},
+			dropped: 1,
+		},
+		{
+			name:    "array too long",
+			flat:    map[string]interface{}{"items[10]": "1", "items[0]": "2"},
+			want:    map[string]interface{}{"items": []interface{}{"2"}},
+			dropped: 1,
+		},
+		{
+			name:    "invalid key",
+			flat:    map[string]interface{}{"a.$b": "1", "c": "2"},
+			want:    map[string]interface{}{"c": "2"},
+			dropped: 1,
+		},
+	}
+
+	for _, test := range tests {
+		nested, dropped := nestData(test.flat, testDataLimits)
+
+		if len(dropped) != test.dropped {
+			t.Errorf("%s: dropped %v, want %d keys", test.name, dropped, test.dropped)
+		}
+
+		if !reflect.DeepEqual(nested, test.want) {
+			t.Errorf("%s: nestData = %v, want %v", test.name, nested, test.want)
+		}
+	}
+}
+
+func TestParticleNestData(t *testing.T) {
+	flat := map[string]interface{}{"a": "1", "a.b": "2"}
+
+	p := &particle{Event: "visit", Data: flat}
+	if err := p.NestData(loadParamLimits(LimitsConfig{MaxDepth: 3, MaxArrayLength: 10, Action: limitActionTruncate})); err != nil {
+		t.Errorf("NestData returned %v in truncate mode", err)
+	}
+
+	if !reflect.DeepEqual(p.Data, map[string]interface{}{"a": "1"}) {
+		t.Errorf("NestData kept %v", p.Data)
+	}
+
+	p = &particle{Event: "visit", Data: flat}
+	if err := p.NestData(loadParamLimits(LimitsConfig{MaxDepth: 3, MaxArrayLength: 10, Action: limitActionReject})); err == nil {
+		t.Error("NestData accepted a conflicting key in reject mode")
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
 	"log"
+	"strings"
 	"time"
 )
 
@@ -13,24 +14,32 @@ const (
 )
 
 type particle struct {
-	Id         bson.ObjectId     `bson:"_id"`
-	BeamId     string            `bson:"beam_id"`
-	Identifier string            `bson:"identifier"`
-	Timestamp  int64             `bson:"timestamp"`
-	Event      string            `bson:"event"`
-	Domain     string            `bson:"domain"`
-	Path       string            `bson:"path"`
-	Data       map[string]string `bson:"data"`
+	Id           bson.ObjectId          `bson:"_id" json:"id"`
+	BeamId       string                 `bson:"beam_id" json:"beam_id"`
+	Identifier   string                 `bson:"identifier" json:"identifier"`
+	SessionId    string                 `bson:"session_id,omitempty" json:"session_id,omitempty"`
+	Timestamp    int64                  `bson:"timestamp" json:"timestamp"`
+	Event        string                 `bson:"event" json:"event"`
+	Domain       string                 `bson:"domain" json:"domain"`
+	Path         string                 `bson:"path" json:"path"`
+	UserAgent    userAgent              `bson:"user_agent" json:"user_agent"`
+	IsBot        bool                   `bson:"is_bot" json:"is_bot"`
+	BotRule      string                 `bson:"bot_rule,omitempty" json:"bot_rule,omitempty"`
+	Quarantine   string                 `bson:"quarantine,omitempty" json:"quarantine,omitempty"`
+	Signed       bool                   `bson:"signed" json:"signed"`
+	SchemaErrors []string               `bson:"schema_errors,omitempty" json:"schema_errors,omitempty"`
+	Data         map[string]interface{} `bson:"data" json:"data"`
+	ip           string
 }
 
-func setupParticlesCollection(session *mgo.Session, config *TetryonConfig) error {
+func setupParticlesCollection(session *mgo.Session, s *site) error {
 	var err error
 	var collectionNames []string
 
 	sessionCopy := session.Copy()
 	defer sessionCopy.Close()
 
-	db := sessionCopy.DB(config.MongoConfig.Database)
+	db := sessionCopy.DB(s.Database)
 
 	collectionNames, err = db.CollectionNames()
 
@@ -39,12 +48,12 @@ func setupParticlesCollection(session *mgo.Session, config *TetryonConfig) error
 	}
 
 	for _, collectionName := range collectionNames {
-		if collectionName == particleCollectionName {
+		if collectionName == s.CollectionPrefix+particleCollectionName {
 			return nil
 		}
 	}
 
-	particleCollection := db.C(particleCollectionName)
+	particleCollection := s.Collection(sessionCopy, particleCollectionName)
 
 	err = particleCollection.Create(&mgo.CollectionInfo{
 		DisableIdIndex: false,
@@ -61,7 +70,7 @@ func setupParticlesCollection(session *mgo.Session, config *TetryonConfig) error
 		return err
 	}
 
-	log.Println("Created new collection: " + particleCollectionName)
+	log.Println("Created new collection: " + s.Database + "." + s.CollectionPrefix + particleCollectionName)
 
 	return nil
 }
@@ -77,6 +86,32 @@ func (p *particle) Init(params map[string]string) error {
 		delete(params, paramRequestId)
 	}
 
+	if _, ok = params[paramUserAgent]; ok {
+		p.UserAgent.Raw = params[paramUserAgent]
+		delete(params, paramUserAgent)
+	}
+
+	if _, ok = params[paramQuarantine]; ok {
+		p.Quarantine = params[paramQuarantine]
+		delete(params, paramQuarantine)
+	}
+
+	if _, ok = params[paramSigned]; ok {
+		p.Signed = params[paramSigned] == "true"
+		delete(params, paramSigned)
+	}
+
+	delete(params, paramSite)
+	delete(params, paramSiteKey)
+	delete(params, paramSig)
+	delete(params, paramSigTimestamp)
+	delete(params, paramSigNonce)
+
+	if _, ok = params[paramClientIp]; ok {
+		p.ip = params[paramClientIp]
+		delete(params, paramClientIp)
+	}
+
 	if _, ok = params[paramBeamId]; !ok {
 		return fmt.Errorf("Particle missing key: %s", paramBeamId)
 	}
@@ -102,27 +137,41 @@ func (p *particle) Init(params map[string]string) error {
 	p.Path = params[paramPath]
 	delete(params, paramPath)
 
-	// We can set the rest of the parameters to just be in Data
-	p.Data = params
+	// Reserved keys that are left over were never meant for Data.
+	for key := range params {
+		if strings.HasPrefix(key, paramPrefix) {
+			delete(params, key)
+		}
+	}
+
+	// We can set the rest of the parameters to just be in Data, typed by their
+	// key suffix if they have one.
+	p.Data = typeDataValues(params)
 
 	return nil
 }
 
 // Save Particle
-func (p *particle) Save(session *mgo.Session, config *TetryonConfig) error {
+func (p *particle) Save(session *mgo.Session, s *site) error {
 	sessionCopy := session.Copy()
 	defer sessionCopy.Close()
 
 	var err error
 
-	particleCollection := sessionCopy.DB(config.MongoConfig.Database).C(particleCollectionName)
+	particleCollection := s.Collection(sessionCopy, particleCollectionName)
 
 	err = particleCollection.Insert(p)
 	if err != nil {
 		return err
 	}
 
-	err = p.ApplyBeamInfo(session, config)
+	err = UpdateBeamProfile(p, session, s)
+
+	if err != nil {
+		return err
+	}
+
+	err = p.ApplyBeamInfo(session, s)
 
 	if err != nil {
 		return err
@@ -131,16 +180,51 @@ func (p *particle) Save(session *mgo.Session, config *TetryonConfig) error {
 	return nil
 }
 
-func (p *particle) ApplyBeamInfo(session *mgo.Session, config *TetryonConfig) error {
+// Save a particle to a collection other than particles ( i.e. bots or
+// quarantine ).  These are kept out of the beams entirely, so the identifier
+// is left as the beam ID.
+func (p *particle) SaveTo(collectionName string, session *mgo.Session, s *site) error {
+	sessionCopy := session.Copy()
+	defer sessionCopy.Close()
+
+	collection := s.Collection(sessionCopy, collectionName)
+
+	return collection.Insert(p)
+}
+
+// Expand keys like "items[0].sku" in Data into nested documents and arrays.
+// Keys that can't be expanded are dropped, and counted against the data key
+// limit - or the particle is rejected, if that is the limits action.
+func (p *particle) NestData(limits *paramLimits) error {
+	data, dropped := nestData(p.Data, limits.config)
+
+	if len(dropped) > 0 {
+		limits.count(limitDataKey)
+
+		if limits.config.Action == limitActionReject {
+			return fmt.Errorf("Particle rejected ( %s ): %s", p.Event, dropped[0])
+		}
+	}
+
+	p.Data = data
+
+	return nil
+}
+
+func (p *particle) ApplyUserAgent(parser *userAgentParser) {
+	p.UserAgent = parser.Parse(p.UserAgent.Raw)
+}
+
+func (p *particle) ApplyBeamInfo(session *mgo.Session, s *site) error {
 	sessionCopy := session.Copy()
 	defer sessionCopy.Close()
 
-	particleCollection := sessionCopy.DB(config.MongoConfig.Database).C(particleCollectionName)
+	particleCollection := s.Collection(sessionCopy, particleCollectionName)
 
 	var err error
 	var b *beam
 
-	b, err = GetBeamById(p.BeamId, session, config)
+	b, err = GetBeamById(p.BeamId, session, s)
 
 	if err != nil {
 		return err
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	defaultQueryLimit = 100
+	maxQueryLimit     = 1000
+)
+
+// Output formats for query APIs.
+const (
+	queryFormatJson   = "json"
+	queryFormatNdjson = "ndjson"
+)
+
+const ndjsonContentType = "application/x-ndjson"
+
+// Carries the cursor for the next page of NDJSON results.
+const nextCursorHeader = "X-Tetryon-Next-Cursor"
+
+// Filters for a page of particles.  Timestamps are unix seconds; from is
+// inclusive and to is exclusive.  Pages are ordered by _id, and the cursor is
+// the _id of the last particle of the previous page.
+type particleQuery struct {
+	BeamId     string
+	Identifier string
+	Event      string
+	Domain     string
+	PathPrefix string
+	From       int64
+	To         int64
+	Cursor     string
+	Descending bool
+	Limit      int
+}
+
+type particlePage struct {
+	Particles  []particle `json:"particles"`
+	NextCursor string     `json:"next_cursor,omitempty"`
+}
+
+// Indexes for the filters of the query API, beyond the one created with the
+// particles collection.  Pages are sorted by _id, so each filter's index ends
+// with it; the timestamp ones serve time ranges, stats and funnels.
+func setupParticleQueryIndexes(session *mgo.Session, s *site) error {
+	sessionCopy := session.Copy()
+	defer sessionCopy.Close()
+
+	particleCollection := s.Collection(sessionCopy, particleCollectionName)
+
+	indexes := [][]string{
+		{"beam_id", "_id"},
+		{"identifier", "_id"},
+		{"event", "_id"},
+		{"identifier", "timestamp"},
+		{"event", "timestamp"},
+		{"timestamp"},
+	}
+
+	for _, key := range indexes {
+		if err := particleCollection.EnsureIndexKey(key...); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func parseQueryLimit(r *http.Request) (int, error) {
+	limit := defaultQueryLimit
+
+	if value := r.FormValue("limit"); len(value) > 0 {
+		var err error
+		if limit, err = strconv.Atoi(value); err != nil || limit <= 0 {
+			return 0, errors.New("invalid limit: " + value)
+		}
+	}
+
+	if limit > maxQueryLimit {
+		limit = maxQueryLimit
+	}
+
+	return limit, nil
+}
+
+func parseQueryTimestamp(r *http.Request, key string) (int64, error) {
+	value := r.FormValue(key)
+
+	if len(value) == 0 {
+		return 0, nil
+	}
+
+	timestamp, err := strconv.ParseInt(value, 10, 64)
+
+	if err != nil {
+		return 0, errors.New("invalid " + key + ": " + value)
+	}
+
+	return timestamp, nil
+}
+
+// The output format of a query: the format parameter if there is one,
+// otherwise by the Accept header.  JSON by default.
+func queryFormat(r *http.Request) (string, error) {
+	switch format := r.FormValue("format"); format {
+	case queryFormatJson, queryFormatNdjson:
+		return format, nil
+	case "":
+	default:
+		return "", errors.New("invalid format: " + format)
+	}
+
+	if strings.Contains(r.Header.Get("Accept"), ndjsonContentType) {
+		return queryFormatNdjson, nil
+	}
+
+	return queryFormatJson, nil
+}
+
+func parseParticleQuery(r *http.Request) (*particleQuery, error) {
+	var err error
+
+	q := &particleQuery{
+		BeamId:     r.FormValue("beam_id"),
+		Identifier: r.FormValue("identifier"),
+		Event:      r.FormValue("event"),
+		Domain:     r.FormValue("domain"),
+		PathPrefix: r.FormValue("path_prefix"),
+		Cursor:     r.FormValue("cursor"),
+	}
+
+	if q.From, err = parseQueryTimestamp(r, "from"); err != nil {
+		return nil, err
+	}
+
+	if q.To, err = parseQueryTimestamp(r, "to"); err != nil {
+		return nil, err
+	}
+
+	if q.Limit, err = parseQueryLimit(r); err != nil {
+		return nil, err
+	}
+
+	if len(q.Cursor) > 0 && !bson.IsObjectIdHex(q.Cursor) {
+		return nil, errors.New("invalid cursor: " + q.Cursor)
+	}
+
+	switch order := r.FormValue("order"); order {
+	case "", "asc":
+	case "desc":
+		q.Descending = true
+	default:
+		return nil, errors.New("invalid order: " + order)
+	}
+
+	return q, nil
+}
+
+func (q *particleQuery) selector() bson.M {
+	selector := bson.M{}
+
+	if len(q.BeamId) > 0 {
+		selector["beam_id"] = q.BeamId
+	}
+
+	if len(q.Identifier) > 0 {
+		selector["identifier"] = q.Identifier
+	}
+
+	if len(q.Event) > 0 {
+		selector["event"] = q.Event
+	}
+
+	if len(q.Domain) > 0 {
+		selector["domain"] = q.Domain
+	}
+
+	if len(q.PathPrefix) > 0 {
+		selector["path"] = bson.M{"$regex": "^" + regexp.QuoteMeta(q.PathPrefix)}
+	}
+
+	if q.From > 0 || q.To > 0 {
+		timestamp := bson.M{}
+		if q.From > 0 {
+			timestamp["$gte"] = q.From
+		}
+		if q.To > 0 {
+			timestamp["$lt"] = q.To
+		}
+		selector["timestamp"] = timestamp
+	}
+
+	if len(q.Cursor) > 0 {
+		if q.Descending {
+			selector["_id"] = bson.M{"$lt": bson.ObjectIdHex(q.Cursor)}
+		} else {
+			selector["_id"] = bson.M{"$gt": bson.ObjectIdHex(q.Cursor)}
+		}
+	}
+
+	return selector
+}
+
+// Read one page of particles.  The next cursor is empty on the last page.
+func GetParticles(session *mgo.Session, s *site, q *particleQuery) (*particlePage, error) {
+	sessionCopy := session.Copy()
+	defer sessionCopy.Close()
+
+	particleCollection := s.Collection(sessionCopy, particleCollectionName)
+
+	sort := "_id"
+	if q.Descending {
+		sort = "-_id"
+	}
+
+	page := &particlePage{Particles: []particle{}}
+
+	// One extra particle tells us whether there is another page.
+	err := particleCollection.Find(q.selector()).Sort(sort).Limit(q.Limit + 1).All(&page.Particles)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(page.Particles) > q.Limit {
+		page.Particles = page.Particles[:q.Limit]
+		page.NextCursor = page.Particles[q.Limit-1].Id.Hex()
+	}
+
+	return page, nil
+}
+
+// GET /v1/particles?site=<id>
+// Filter with beam_id, identifier, event, domain, path_prefix, from and to.
+// Page with cursor, order ( asc or desc ) and limit.  format is json or
+// ndjson.  Every parameter is optional, except site when there is more than
+// one.
+func handleParticlesRequest(session *mgo.Session, sites *siteRouter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			writeJsonError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+
+		s, status, err := adminSite(sites, r)
+
+		if err != nil {
+			writeJsonError(w, status, err.Error())
+			return
+		}
+
+		format, err := queryFormat(r)
+
+		if err != nil {
+			writeJsonError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		q, err := parseParticleQuery(r)
+
+		if err != nil {
+			writeJsonError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		page, err := GetParticles(session, s, q)
+
+		if err != nil {
+			log.Println(err)
+			writeJsonError(w, http.StatusInternalServerError, "could not read particles")
+			return
+		}
+
+		if format == queryFormatJson {
+			writeJson(w, http.StatusOK, page)
+			return
+		}
+
+		w.Header().Set("Content-Type", ndjsonContentType)
+		if len(page.NextCursor) > 0 {
+			w.Header().Set(nextCursorHeader, page.NextCursor)
+		}
+
+		encoder := json.NewEncoder(w)
+
+		for _, p := range page.Particles {
+			if err := encoder.Encode(p); err != nil {
+				log.Println(err)
+				return
+			}
+		}
+	}
+}
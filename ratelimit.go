@@ -0,0 +1,156 @@
+package main
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Responses when a request is throttled.
+const (
+	rateLimitResponseReject = "reject"
+	rateLimitResponseDrop   = "drop"
+)
+
+const defaultRateLimitMaxKeys = 100000
+
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// A token bucket per key, refilled at rate tokens per second up to burst.
+// At most maxKeys buckets are kept; idle buckets are pruned when it is full.
+type rateLimiter struct {
+	rate      float64
+	burst     float64
+	maxKeys   int
+	buckets   map[string]*tokenBucket
+	throttled int64
+	mutex     sync.Mutex
+}
+
+type requestLimiter struct {
+	response string
+	ip       *rateLimiter
+	beam     *rateLimiter
+}
+
+func loadRequestLimiter(rateLimitConfig RateLimitConfig) *requestLimiter {
+	maxKeys := rateLimitConfig.MaxKeys
+	if maxKeys <= 0 {
+		maxKeys = defaultRateLimitMaxKeys
+	}
+
+	return &requestLimiter{
+		response: rateLimitConfig.Response,
+		ip:       newRateLimiter(rateLimitConfig.IpRate, rateLimitConfig.IpBurst, maxKeys),
+		beam:     newRateLimiter(rateLimitConfig.BeamRate, rateLimitConfig.BeamBurst, maxKeys),
+	}
+}
+
+func newRateLimiter(rate float64, burst int, maxKeys int) *rateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+
+	return &rateLimiter{
+		rate:    rate,
+		burst:   float64(burst),
+		maxKeys: maxKeys,
+		buckets: make(map[string]*tokenBucket),
+	}
+}
+
+// Take a token for key, returning false if the request should be throttled.
+// A rate of 0 disables the limiter.
+func (l *rateLimiter) Allow(key string) bool {
+	if l.rate <= 0 {
+		return true
+	}
+
+	now := time.Now()
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	bucket, ok := l.buckets[key]
+
+	if !ok {
+		if len(l.buckets) >= l.maxKeys {
+			l.prune(now)
+		}
+
+		// Still full - fail open rather than grow without bound.
+		if len(l.buckets) >= l.maxKeys {
+			return true
+		}
+
+		bucket = &tokenBucket{tokens: l.burst, updated: now}
+		l.buckets[key] = bucket
+	}
+
+	bucket.tokens += now.Sub(bucket.updated).Seconds() * l.rate
+	if bucket.tokens > l.burst {
+		bucket.tokens = l.burst
+	}
+	bucket.updated = now
+
+	if bucket.tokens < 1 {
+		l.throttled++
+		return false
+	}
+
+	bucket.tokens--
+
+	return true
+}
+
+// Remove buckets that have refilled completely; they behave the same as new ones.
+func (l *rateLimiter) prune(now time.Time) {
+	for key, bucket := range l.buckets {
+		if bucket.tokens+now.Sub(bucket.updated).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+func (l *rateLimiter) Throttled() int64 {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	return l.throttled
+}
+
+// Take a token for the client's address, and for its beam if it sent one.
+func (l *requestLimiter) Allow(r *http.Request, beamId string) bool {
+	return l.ip.Allow(clientIp(r)) &&
+		(len(beamId) == 0 || l.beam.Allow(beamId))
+}
+
+// Wrap a handler so requests over the per-IP or per-beam limit never reach
+// it.  Split requests are limited by the requestAdmitter instead, once for
+// all of their parts.
+func limitRequests(limiter *requestLimiter, gifData []byte, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if limiter.Allow(r, r.FormValue(paramBeamId)) {
+			handler(w, r)
+			return
+		}
+
+		if limiter.response == rateLimitResponseReject {
+			http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+			return
+		}
+
+		w.Header().Set("Content-Type", "image/gif")
+		io.WriteString(w, string(gifData))
+	}
+}
+
+func logRateLimits(limiter *requestLimiter) {
+	log.Printf("Throttled requests ( ip ): %d", limiter.ip.Throttled())
+	log.Printf("Throttled requests ( beam ): %d", limiter.beam.Throttled())
+}
@@ -6,10 +6,12 @@ import (
 	"gopkg.in/mgo.v2"
 	"io"
 	"log"
+	"net"
 	"net/http"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 )
 
 type request struct {
@@ -17,6 +19,23 @@ type request struct {
 	Type          string
 	Parameters    map[string]string
 	ReceivedParts map[int]bool
+	Size          int
+	OverLimit     bool
+	Started       time.Time
+	limits        *paramLimits
+}
+
+// Everything the persistence stage needs to handle a received request.
+type pipeline struct {
+	session  *mgo.Session
+	sites    *siteRouter
+	uaParser *userAgentParser
+	bots     *botFilter
+	schemas  *schemaRegistry
+	sessions *sessionizer
+	stream   *particleStream
+	webhooks *webhookDispatcher
+	limits   *paramLimits
 }
 
 // Reserved parameter keys
@@ -29,12 +48,52 @@ const (
 	paramDomain         = paramPrefix + "Domain"
 	paramPath           = paramPrefix + "Path"
 	paramBeamIdentifier = paramPrefix + "Identifier"
+	paramUserAgent      = paramPrefix + "UserAgent"
+	paramClientIp       = paramPrefix + "ClientIp"
+	paramQuarantine     = paramPrefix + "Quarantine"
+	paramSig            = paramPrefix + "Sig"
+	paramSigned         = paramPrefix + "Signed"
+	paramSigTimestamp   = paramPrefix + "Timestamp"
+	paramSigNonce       = paramPrefix + "Nonce"
+	paramSiteKey        = paramPrefix + "Key"
+	paramSite           = paramPrefix + "Site"
 )
 
+// Reserved parameters a client may send.  Any other parameter starting with
+// paramPrefix is either added by the server or unknown, and is removed from
+// requests as they arrive.
+var clientParams = map[string]bool{
+	paramRequestId:      true,
+	paramBeamId:         true,
+	paramEvent:          true,
+	paramDomain:         true,
+	paramPath:           true,
+	paramBeamIdentifier: true,
+	paramSig:            true,
+	paramSigTimestamp:   true,
+	paramSigNonce:       true,
+	paramSiteKey:        true,
+}
+
+// Whether key is a reserved parameter, sent by the client or added by the
+// server.
+func reservedParam(key string) bool {
+	return clientParams[key] || unsignedParams[key]
+}
+
+// Remove the parameters a client may not send.
+func removeServerParams(params map[string]string) {
+	for key := range params {
+		if strings.HasPrefix(key, paramPrefix) && !clientParams[key] {
+			delete(params, key)
+		}
+	}
+}
+
 // 1x1 Transparent GIF
 const transparent1x1Gif = "R0lGODlhAQABAIAAAAAAAP///yH5BAEAAAAALAAAAAABAAEAAAIBRAA7"
 
-func (r *request) Init(reqType string, reqParams map[string]string) {
+func (r *request) Init(reqType string, reqParams map[string]string, limits *paramLimits) {
 	id, _, total, err := splitRequestId(reqParams[paramRequestId])
 
 	if err != nil {
@@ -45,6 +104,8 @@ func (r *request) Init(reqType string, reqParams map[string]string) {
 	r.Type = reqType
 	r.ReceivedParts = make(map[int]bool)
 	r.Parameters = make(map[string]string)
+	r.Started = time.Now()
+	r.limits = limits
 
 	for i := 1; i <= total; i++ {
 		r.ReceivedParts[i] = false
@@ -58,8 +119,20 @@ func (r *request) AddParams(parameters map[string]string) {
 
 	r.ReceivedParts[part] = true
 
+	if r.OverLimit {
+		return
+	}
+
+	parameters, ok := r.limits.CheckRequest(r, parameters)
+
+	if !ok {
+		r.OverLimit = true
+		return
+	}
+
 	for key, value := range parameters {
 		r.Parameters[key] = value
+		r.Size += len(key) + len(value)
 	}
 }
 
@@ -88,7 +161,7 @@ func loadResponseGif(base64Data string) ([]byte, error) {
 	return base64.StdEncoding.DecodeString(base64Data)
 }
 
-func handleRequestParameters(parameters map[string]string, activeRequests map[string]*request, requestReceivedChannel chan request, mutex *sync.Mutex) {
+func handleRequestParameters(parameters map[string]string, activeRequests map[string]*request, requestReceivedChannel chan request, mutex *sync.Mutex, sites *siteRouter, verifier *requestVerifier, limits *paramLimits) {
 	id, _, _, _ := splitRequestId(parameters[paramRequestId])
 
 	requestType := parameters[paramsTypeKey]
@@ -99,21 +172,72 @@ func handleRequestParameters(parameters map[string]string, activeRequests map[st
 		activeRequests[id].AddParams(parameters)
 	} else {
 		activeRequests[id] = &request{Type: requestType}
-		activeRequests[id].Init(requestType, parameters)
+		activeRequests[id].Init(requestType, parameters, limits)
 	}
 
 	if activeRequests[id].ReceivedAllParts() {
 		delete(activeRequests[id].Parameters, paramsTypeKey)
-		requestReceivedChannel <- *activeRequests[id]
+
+		if acceptRequest(activeRequests[id], sites, verifier, limits) {
+			requestReceivedChannel <- *activeRequests[id]
+		}
+
 		delete(activeRequests, id)
 	}
 
 	mutex.Unlock()
 }
 
-func handleReceivedRequest(r request, session *mgo.Session, config *TetryonConfig) error {
+// Whether a reassembled request should be handled.  Signatures cover the
+// whole request as it was sent, and the domain may be in any part, so they
+// are checked once every part has arrived - before the limits change any
+// parameters.
+func acceptRequest(r *request, sites *siteRouter, verifier *requestVerifier, limits *paramLimits) bool {
+	if r.OverLimit {
+		return false
+	}
+
+	if r.Type == "particle" {
+		s, ok := sites.Get(r.Parameters[paramSite])
+
+		if !ok || !verifier.Verify(r.Parameters, s) || !s.domains.CheckDomain(r.Parameters) {
+			return false
+		}
+	}
+
+	return limits.CheckParams(r.Parameters)
+}
+
+// Remove requests that are still missing parts requestExpirySeconds after
+// their first part arrived; the rest were lost, or never sent.  Returns how
+// many were removed.
+func expireActiveRequests(activeRequests map[string]*request, mutex *sync.Mutex, now time.Time) int64 {
+	var expired int64
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	for id, r := range activeRequests {
+		if now.Sub(r.Started) > requestExpirySeconds*time.Second {
+			delete(activeRequests, id)
+			expired++
+		}
+	}
+
+	return expired
+}
+
+func handleReceivedRequest(r request, pl *pipeline) error {
 	var err error
 
+	session := pl.session
+
+	s, ok := pl.sites.Get(r.Parameters[paramSite])
+
+	if !ok {
+		return fmt.Errorf("Request for unknown site: %s", r.Parameters[paramSite])
+	}
+
 	if r.Type == "particle" {
 		p := &particle{}
 
@@ -122,10 +246,49 @@ func handleReceivedRequest(r request, session *mgo.Session, config *TetryonConfi
 			return err
 		}
 
-		err = p.Save(session, config)
+		err = p.NestData(pl.limits)
 		if err != nil {
 			return err
 		}
+
+		p.ApplyUserAgent(pl.uaParser)
+
+		if len(p.Quarantine) > 0 {
+			return p.SaveTo(quarantinedParticleCollectionName, session, s)
+		}
+
+		switch pl.bots.Classify(p) {
+		case botActionDrop:
+			return nil
+		case botActionCollection:
+			return p.SaveTo(botParticleCollectionName, session, s)
+		}
+
+		if !pl.schemas.Validate(p) {
+			return nil
+		}
+
+		pl.schemas.ApplyTypes(p)
+
+		err = pl.sessions.Assign(p, session, s)
+		if err != nil {
+			return err
+		}
+
+		err = p.Save(session, s)
+		if err != nil {
+			return err
+		}
+
+		err = s.RecordUsage(session, time.Unix(p.Timestamp, 0))
+		if err != nil {
+			return err
+		}
+
+		s.rollups.Add(p)
+		s.uniques.Add(p)
+		pl.stream.Publish(s.Id, p)
+		pl.webhooks.Publish(s, p)
 	} else if r.Type == "beam" {
 		b := &beam{}
 
@@ -133,13 +296,18 @@ func handleReceivedRequest(r request, session *mgo.Session, config *TetryonConfi
 			return fmt.Errorf("Beam request missing key: %s", paramBeamId)
 		}
 
-		b, err = GetBeamById(r.Parameters[paramBeamId], session, config)
+		b, err = GetBeamById(r.Parameters[paramBeamId], session, s)
+
+		if err != nil {
+			return err
+		}
 
+		err = b.Update(r.Parameters, session, s)
 		if err != nil {
 			return err
 		}
 
-		err = b.Update(r.Parameters, session, config)
+		err = UpdateIdentity(b.Identifier, identityTraits(r.Parameters), time.Now().UTC().Unix(), session, s)
 		if err != nil {
 			return err
 		}
@@ -148,21 +316,40 @@ func handleReceivedRequest(r request, session *mgo.Session, config *TetryonConfi
 	return nil
 }
 
-func handleBeamRequest(gifData []byte, requestParamChannel chan map[string]string) http.HandlerFunc {
+func handleBeamRequest(gifData []byte, requestParamChannel chan map[string]string, admitter *requestAdmitter) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.ParseForm() != nil {
 			log.Println("Could not parse form.")
 			return
 		}
 
-		requestParams := make(map[string]string)
+		requestParams := formParams(r.Form)
+		removeServerParams(requestParams)
+
+		requestId, part, total, err := splitRequestId(requestParams[paramRequestId])
 
-		for key, values := range r.Form {
-			requestParams[key] = values[0]
+		if err != nil {
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
 		}
 
 		requestParams[paramsTypeKey] = "beam"
 
+		a := admitter.Admit(r, requestId, part, total, requestParams)
+
+		if a.status != 0 {
+			http.Error(w, http.StatusText(a.status), a.status)
+			return
+		}
+
+		if a.drop {
+			w.Header().Set("Content-Type", "image/gif")
+			io.WriteString(w, string(gifData))
+			return
+		}
+
+		requestParams[paramSite] = a.site.Id
+
 		requestParamChannel <- requestParams
 
 		w.Header().Set("Content-Type", "image/gif")
@@ -170,20 +357,51 @@ func handleBeamRequest(gifData []byte, requestParamChannel chan map[string]strin
 	}
 }
 
-func handleParticleRequest(gifData []byte, requestParamChannel chan map[string]string) http.HandlerFunc {
+func handleParticleRequest(gifData []byte, requestParamChannel chan map[string]string, admitter *requestAdmitter) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.ParseForm() != nil {
 			log.Println("Could not parse form.")
 			return
 		}
 
-		requestParams := make(map[string]string)
+		requestParams := formParams(r.Form)
+		removeServerParams(requestParams)
 
-		for key, values := range r.Form {
-			requestParams[key] = values[0]
+		requestId, part, total, err := splitRequestId(requestParams[paramRequestId])
+
+		if err != nil {
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
 		}
 
 		requestParams[paramsTypeKey] = "particle"
+		requestParams[paramUserAgent] = r.UserAgent()
+		requestParams[paramClientIp] = clientIp(r)
+
+		if sig := r.Header.Get(signatureHeader); len(sig) > 0 {
+			requestParams[paramSig] = sig
+		}
+
+		a := admitter.Admit(r, requestId, part, total, requestParams)
+
+		if a.status != 0 {
+			http.Error(w, http.StatusText(a.status), a.status)
+			return
+		}
+
+		if a.drop {
+			w.Header().Set("Content-Type", "image/gif")
+			io.WriteString(w, string(gifData))
+			return
+		}
+
+		s := a.site
+
+		requestParams[paramSite] = s.Id
+
+		if len(a.quarantine) > 0 {
+			requestParams[paramQuarantine] = a.quarantine
+		}
 
 		requestParamChannel <- requestParams
 
@@ -192,6 +410,17 @@ func handleParticleRequest(gifData []byte, requestParamChannel chan map[string]s
 	}
 }
 
+// The address of the client that sent the request, without the port.
+func clientIp(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return host
+}
+
 /**
  * Split an encoded request ID into the ID, part ( of chunks ), and total ( chunks )
  * Encoded ID format: [id]:[part]-[total]
@@ -203,8 +432,17 @@ func handleParticleRequest(gifData []byte, requestParamChannel chan map[string]s
  */
 func splitRequestId(encodedId string) (string, int, int, error) {
 	a := strings.Split(encodedId, ":")
+
+	if len(a) != 2 || len(a[0]) == 0 {
+		return "", 0, 0, fmt.Errorf("Invalid request ID: %s", encodedId)
+	}
+
 	b := strings.Split(a[1], "-")
 
+	if len(b) != 2 {
+		return "", 0, 0, fmt.Errorf("Invalid request ID: %s", encodedId)
+	}
+
 	id := a[0]
 
 	var err error
@@ -223,5 +461,9 @@ func splitRequestId(encodedId string) (string, int, int, error) {
 		return "", 0, 0, err
 	}
 
+	if part < 1 || part > total {
+		return "", 0, 0, fmt.Errorf("Invalid request ID: %s", encodedId)
+	}
+
 	return id, int(part), int(total), nil
 }
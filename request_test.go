@@ -0,0 +1,90 @@
+package main
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSplitRequestId(t *testing.T) {
+	tests := []struct {
+		encoded string
+		id      string
+		part    int
+		total   int
+		valid   bool
+	}{
+		{"abc:1-1", "abc", 1, 1, true},
+		{"abc:2-3", "abc", 2, 3, true},
+		{"", "", 0, 0, false},
+		{"abc", "", 0, 0, false},
+		{":1-1", "", 0, 0, false},
+		{"abc:1", "", 0, 0, false},
+		{"abc:x-1", "", 0, 0, false},
+		{"abc:0-1", "", 0, 0, false},
+		{"abc:3-2", "", 0, 0, false},
+		{"abc:1-1:2", "", 0, 0, false},
+	}
+
+	for _, test := range tests {
+		id, part, total, err := splitRequestId(test.encoded)
+
+		if (err == nil) != test.valid {
+			t.Errorf("splitRequestId(%q) error = %v, want valid %v", test.encoded, err, test.valid)
+			continue
+		}
+
+		if id != test.id || part != test.part || total != test.total {
+			t.Errorf("splitRequestId(%q) = %q, %d, %d, want %q, %d, %d", test.encoded, id, part, total, test.id, test.part, test.total)
+		}
+	}
+}
+
+func TestExpireActiveRequests(t *testing.T) {
+	now := time.Now()
+
+	activeRequests := map[string]*request{
+		"old":    {Id: "old", Started: now.Add(-2 * requestExpirySeconds * time.Second)},
+		"recent": {Id: "recent", Started: now.Add(-time.Second)},
+	}
+
+	if expired := expireActiveRequests(activeRequests, &sync.Mutex{}, now); expired != 1 {
+		t.Errorf("expired %d requests, want 1", expired)
+	}
+
+	if _, ok := activeRequests["old"]; ok {
+		t.Error("old request was not expired")
+	}
+
+	if _, ok := activeRequests["recent"]; !ok {
+		t.Error("recent request was expired")
+	}
+}
+
+func TestRemoveServerParams(t *testing.T) {
+	params := map[string]string{
+		paramRequestId:  "abc:1-1",
+		paramEvent:      "visit",
+		paramSig:        "00",
+		paramSite:       "shop",
+		paramQuarantine: "origin",
+		paramSigned:     "true",
+		paramsTypeKey:   "particle",
+		"_ttynFoo":      "1",
+		"a":             "1",
+	}
+
+	removeServerParams(params)
+
+	want := map[string]string{
+		paramRequestId: "abc:1-1",
+		paramEvent:     "visit",
+		paramSig:       "00",
+		"a":            "1",
+	}
+
+	if !reflect.DeepEqual(params, want) {
+		t.Errorf("params = %v, want %v", params, want)
+	}
+}
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	retentionCohortWeek  = "week"
+	retentionCohortMonth = "month"
+)
+
+const (
+	defaultRetentionPeriods = 8
+	// Activity is kept as a bitmask per identifier.
+	maxRetentionPeriods = 64
+)
+
+const csvContentType = "text/csv"
+
+type retentionQuery struct {
+	Cohort  string
+	By      string
+	Event   string
+	From    int64
+	To      int64
+	Periods int
+}
+
+// Of the identifiers ( or beams ) first seen in the cohort, how many came
+// back ( and did the event, if there is one ) in each period since.  Period 0
+// is the cohort's own.
+type retentionCohort struct {
+	Start   int64   `json:"start"`
+	Size    int64   `json:"size"`
+	Periods []int64 `json:"periods"`
+}
+
+type retentionResult struct {
+	Cohort  string            `json:"cohort"`
+	By      string            `json:"by"`
+	Event   string            `json:"event,omitempty"`
+	Cohorts []retentionCohort `json:"cohorts"`
+}
+
+// The start of the week ( from Monday, UTC ) or month a timestamp is in.
+func retentionPeriodStart(cohort string, timestamp int64) int64 {
+	t := time.Unix(timestamp, 0).UTC()
+
+	if cohort == retentionCohortMonth {
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC).Unix()
+	}
+
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	weekday := (int(day.Weekday()) + 6) % 7
+
+	return day.AddDate(0, 0, -weekday).Unix()
+}
+
+// The start of the period n periods after start.
+func retentionPeriodAdd(cohort string, start int64, n int) int64 {
+	t := time.Unix(start, 0).UTC()
+
+	if cohort == retentionCohortMonth {
+		return t.AddDate(0, n, 0).Unix()
+	}
+
+	return t.AddDate(0, 0, 7*n).Unix()
+}
+
+// How many periods after the cohort start a timestamp is.
+func retentionPeriodIndex(cohort string, start int64, timestamp int64) int {
+	if cohort == retentionCohortMonth {
+		s := time.Unix(start, 0).UTC()
+		t := time.Unix(timestamp, 0).UTC()
+
+		return (t.Year()-s.Year())*12 + int(t.Month()) - int(s.Month())
+	}
+
+	return int((retentionPeriodStart(cohort, timestamp) - start) / (7 * 86400))
+}
+
+func parseRetentionQuery(r *http.Request) (*retentionQuery, error) {
+	var err error
+
+	q := &retentionQuery{
+		Cohort:  r.FormValue("cohort"),
+		By:      r.FormValue("by"),
+		Event:   r.FormValue("event"),
+		Periods: defaultRetentionPeriods,
+	}
+
+	if len(q.Cohort) == 0 {
+		q.Cohort = retentionCohortWeek
+	}
+
+	if q.Cohort != retentionCohortWeek && q.Cohort != retentionCohortMonth {
+		return nil, errors.New("invalid cohort: " + q.Cohort)
+	}
+
+	if len(q.By) == 0 {
+		q.By = funnelByIdentifier
+	}
+
+	if q.By != funnelByIdentifier && q.By != funnelByBeam {
+		return nil, errors.New("invalid by: " + q.By)
+	}
+
+	if value := r.FormValue("periods"); len(value) > 0 {
+		if q.Periods, err = strconv.Atoi(value); err != nil || q.Periods <= 0 || q.Periods > maxRetentionPeriods {
+			return nil, errors.New("invalid periods: " + value)
+		}
+	}
+
+	if q.From, err = parseQueryTimestamp(r, "from"); err != nil {
+		return nil, err
+	}
+
+	if q.To, err = parseQueryTimestamp(r, "to"); err != nil {
+		return nil, err
+	}
+
+	if q.To == 0 {
+		q.To = time.Now().Unix()
+	}
+
+	if q.From == 0 {
+		q.From = retentionPeriodAdd(q.Cohort, retentionPeriodStart(q.Cohort, q.To), -q.Periods)
+	}
+
+	q.From = retentionPeriodStart(q.Cohort, q.From)
+
+	if q.From >= q.To {
+		return nil, errors.New("from must be before to")
+	}
+
+	return q, nil
+}
+
+// Read the cohort start of every identifier ( or beam ) first seen in the
+// range, from the beam profiles.
+func (q *retentionQuery) cohorts(session *mgo.Session, s *site) (map[string]int64, error) {
+	beamCollection := s.Collection(session, beamCollectionName)
+
+	key := "$identifier"
+	if q.By == funnelByBeam {
+		key = "$beam_id"
+	}
+
+	pipeline := []bson.M{
+		{"$match": bson.M{"first_seen": bson.M{"$exists": true}}},
+		{"$group": bson.M{"_id": key, "first_seen": bson.M{"$min": "$first_seen"}}},
+		{"$match": bson.M{
+			"_id":        bson.M{"$nin": []interface{}{nil, ""}},
+			"first_seen": bson.M{"$gte": q.From, "$lt": q.To},
+		}},
+	}
+
+	var result struct {
+		Key       string `bson:"_id"`
+		FirstSeen int64  `bson:"first_seen"`
+	}
+
+	cohorts := make(map[string]int64)
+
+	iter := beamCollection.Pipe(pipeline).AllowDiskUse().Iter()
+
+	for iter.Next(&result) {
+		cohorts[result.Key] = retentionPeriodStart(q.Cohort, result.FirstSeen)
+	}
+
+	return cohorts, iter.Close()
+}
+
+// Build the retention matrix.  Cohorts come from the beam profiles'
+// first_seen ( so beams saved before profiles were kept aren't counted ), and
+// activity from the days each identifier has particles on.  Rollups can't be
+// used for either: they count particles and beams, but don't record which.
+func GetRetention(session *mgo.Session, s *site, q *retentionQuery) (*retentionResult, error) {
+	sessionCopy := session.Copy()
+	defer sessionCopy.Close()
+
+	cohorts, err := q.cohorts(sessionCopy, s)
+
+	if err != nil {
+		return nil, err
+	}
+
+	particleCollection := s.Collection(sessionCopy, particleCollectionName)
+
+	key := "$identifier"
+	if q.By == funnelByBeam {
+		key = "$beam_id"
+	}
+
+	end := retentionPeriodAdd(q.Cohort, retentionPeriodStart(q.Cohort, q.To-1), q.Periods)
+
+	match := bson.M{"timestamp": bson.M{"$gte": q.From, "$lt": end}}
+	if len(q.Event) > 0 {
+		match["event"] = q.Event
+	}
+
+	pipeline := []bson.M{
+		{"$match": match},
+		{"$group": bson.M{"_id": bson.M{
+			"key": key,
+			"day": bson.M{"$subtract": []interface{}{"$timestamp", bson.M{"$mod": []interface{}{"$timestamp", 86400}}}},
+		}}},
+	}
+
+	var result struct {
+		Id struct {
+			Key string `bson:"key"`
+			Day int64  `bson:"day"`
+		} `bson:"_id"`
+	}
+
+	activity := make(map[string]uint64)
+
+	iter := particleCollection.Pipe(pipeline).AllowDiskUse().Iter()
+
+	for iter.Next(&result) {
+		start, ok := cohorts[result.Id.Key]
+
+		if !ok {
+			continue
+		}
+
+		if index := retentionPeriodIndex(q.Cohort, start, result.Id.Day); index >= 0 && index < q.Periods {
+			activity[result.Id.Key] |= 1 << uint(index)
+		}
+	}
+
+	if err = iter.Close(); err != nil {
+		return nil, err
+	}
+
+	retention := &retentionResult{Cohort: q.Cohort, By: q.By, Event: q.Event, Cohorts: []retentionCohort{}}
+	byStart := make(map[int64]*retentionCohort)
+
+	for start := q.From; start < q.To; start = retentionPeriodAdd(q.Cohort, start, 1) {
+		retention.Cohorts = append(retention.Cohorts, retentionCohort{Start: start, Periods: make([]int64, q.Periods)})
+	}
+
+	for i := range retention.Cohorts {
+		byStart[retention.Cohorts[i].Start] = &retention.Cohorts[i]
+	}
+
+	for k, start := range cohorts {
+		c, ok := byStart[start]
+
+		if !ok {
+			continue
+		}
+
+		c.Size++
+
+		for index := 0; index < q.Periods; index++ {
+			if activity[k]&(1<<uint(index)) != 0 {
+				c.Periods[index]++
+			}
+		}
+	}
+
+	return retention, nil
+}
+
+// One row per cohort: its start date, size and the count for each period.
+func writeRetentionCsv(w http.ResponseWriter, retention *retentionResult, periods int) {
+	w.Header().Set("Content-Type", csvContentType)
+
+	writer := csv.NewWriter(w)
+
+	header := []string{"cohort", "size"}
+	for index := 0; index < periods; index++ {
+		header = append(header, strconv.Itoa(index))
+	}
+	writer.Write(header)
+
+	for _, c := range retention.Cohorts {
+		row := []string{time.Unix(c.Start, 0).UTC().Format("2006-01-02"), strconv.FormatInt(c.Size, 10)}
+		for _, count := range c.Periods {
+			row = append(row, strconv.FormatInt(count, 10))
+		}
+		writer.Write(row)
+	}
+
+	writer.Flush()
+
+	if err := writer.Error(); err != nil {
+		log.Println(err)
+	}
+}
+
+// GET /v1/retention?site=<id>&cohort=<week|month>&by=<identifier|beam>&event=
+// with periods, from, to and format=<json|csv>.  Cohorts start between from and
+// to ( the last periods cohorts by default ).
+func handleRetentionRequest(session *mgo.Session, sites *siteRouter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			writeJsonError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+
+		s, status, err := adminSite(sites, r)
+
+		if err != nil {
+			writeJsonError(w, status, err.Error())
+			return
+		}
+
+		format := r.FormValue("format")
+
+		if len(format) > 0 && format != queryFormatJson && format != "csv" {
+			writeJsonError(w, http.StatusBadRequest, "invalid format: "+format)
+			return
+		}
+
+		q, err := parseRetentionQuery(r)
+
+		if err != nil {
+			writeJsonError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		retention, err := GetRetention(session, s, q)
+
+		if err != nil {
+			log.Println(err)
+			writeJsonError(w, http.StatusInternalServerError, "could not compute retention")
+			return
+		}
+
+		if format == "csv" {
+			writeRetentionCsv(w, retention, q.Periods)
+			return
+		}
+
+		writeJson(w, http.StatusOK, retention)
+	}
+}
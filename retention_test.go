@@ -0,0 +1,79 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func retentionDate(year int, month time.Month, day int, hour int) int64 {
+	return time.Date(year, month, day, hour, 0, 0, 0, time.UTC).Unix()
+}
+
+func TestRetentionPeriodStart(t *testing.T) {
+	tests := []struct {
+		cohort    string
+		timestamp int64
+		want      int64
+	}{
+		// 2015-01-05 was a Monday.
+		{retentionCohortWeek, retentionDate(2015, 1, 5, 0), retentionDate(2015, 1, 5, 0)},
+		{retentionCohortWeek, retentionDate(2015, 1, 7, 13), retentionDate(2015, 1, 5, 0)},
+		{retentionCohortWeek, retentionDate(2015, 1, 11, 23), retentionDate(2015, 1, 5, 0)},
+		{retentionCohortWeek, retentionDate(2015, 1, 12, 0), retentionDate(2015, 1, 12, 0)},
+		{retentionCohortWeek, retentionDate(2015, 1, 1, 12), retentionDate(2014, 12, 29, 0)},
+		{retentionCohortMonth, retentionDate(2015, 1, 1, 0), retentionDate(2015, 1, 1, 0)},
+		{retentionCohortMonth, retentionDate(2015, 2, 28, 23), retentionDate(2015, 2, 1, 0)},
+	}
+
+	for _, test := range tests {
+		if got := retentionPeriodStart(test.cohort, test.timestamp); got != test.want {
+			t.Errorf("retentionPeriodStart(%s, %d) = %d, want %d", test.cohort, test.timestamp, got, test.want)
+		}
+	}
+}
+
+func TestRetentionPeriodAdd(t *testing.T) {
+	tests := []struct {
+		cohort string
+		start  int64
+		n      int
+		want   int64
+	}{
+		{retentionCohortWeek, retentionDate(2015, 1, 5, 0), 0, retentionDate(2015, 1, 5, 0)},
+		{retentionCohortWeek, retentionDate(2015, 1, 5, 0), 1, retentionDate(2015, 1, 12, 0)},
+		{retentionCohortWeek, retentionDate(2015, 1, 5, 0), -2, retentionDate(2014, 12, 22, 0)},
+		{retentionCohortMonth, retentionDate(2015, 1, 1, 0), 1, retentionDate(2015, 2, 1, 0)},
+		{retentionCohortMonth, retentionDate(2015, 11, 1, 0), 3, retentionDate(2016, 2, 1, 0)},
+		{retentionCohortMonth, retentionDate(2015, 1, 1, 0), -1, retentionDate(2014, 12, 1, 0)},
+	}
+
+	for _, test := range tests {
+		if got := retentionPeriodAdd(test.cohort, test.start, test.n); got != test.want {
+			t.Errorf("retentionPeriodAdd(%s, %d, %d) = %d, want %d", test.cohort, test.start, test.n, got, test.want)
+		}
+	}
+}
+
+func TestRetentionPeriodIndex(t *testing.T) {
+	tests := []struct {
+		cohort    string
+		start     int64
+		timestamp int64
+		want      int
+	}{
+		{retentionCohortWeek, retentionDate(2015, 1, 5, 0), retentionDate(2015, 1, 11, 23), 0},
+		{retentionCohortWeek, retentionDate(2015, 1, 5, 0), retentionDate(2015, 1, 12, 0), 1},
+		{retentionCohortWeek, retentionDate(2015, 1, 5, 0), retentionDate(2015, 2, 4, 0), 4},
+		{retentionCohortWeek, retentionDate(2015, 1, 5, 0), retentionDate(2015, 1, 4, 0), -1},
+		{retentionCohortMonth, retentionDate(2015, 1, 1, 0), retentionDate(2015, 1, 31, 23), 0},
+		{retentionCohortMonth, retentionDate(2015, 1, 1, 0), retentionDate(2015, 2, 1, 0), 1},
+		{retentionCohortMonth, retentionDate(2015, 11, 1, 0), retentionDate(2016, 1, 15, 0), 2},
+		{retentionCohortMonth, retentionDate(2015, 1, 1, 0), retentionDate(2014, 12, 31, 0), -1},
+	}
+
+	for _, test := range tests {
+		if got := retentionPeriodIndex(test.cohort, test.start, test.timestamp); got != test.want {
+			t.Errorf("retentionPeriodIndex(%s, %d, %d) = %d, want %d", test.cohort, test.start, test.timestamp, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	rollupCollectionName = "rollups"
+)
+
+const rollupFlushIntervalSeconds = 10
+
+// Rollups are kept per hour and per day.
+var rollupPeriods = []string{"hour", "day"}
+
+// What particles are counted by.  campaign is the joined utm values, as on
+// sessions.
+var rollupDimensions = []string{"event", "domain", "path", "campaign"}
+
+// Particle counts for one period, dimension and value, i.e. the "visit"
+// event in the hour starting at 1420912800.
+type rollup struct {
+	Id        string `bson:"_id" json:"-"`
+	Period    string `bson:"period" json:"period"`
+	Start     int64  `bson:"start" json:"start"`
+	Dimension string `bson:"dimension" json:"dimension"`
+	Value     string `bson:"value" json:"value"`
+	Particles int64  `bson:"particles" json:"particles"`
+}
+
+type rollupKey struct {
+	Period    string
+	Start     int64
+	Dimension string
+	Value     string
+}
+
+// Counts particles in memory until they are flushed to the rollups
+// collection.
+type rollupCounter struct {
+	counts map[rollupKey]int64
+	mutex  sync.Mutex
+}
+
+func newRollupCounter() *rollupCounter {
+	return &rollupCounter{
+		counts: make(map[rollupKey]int64),
+	}
+}
+
+func validRollupDimension(dimension string) bool {
+	for _, d := range rollupDimensions {
+		if d == dimension {
+			return true
+		}
+	}
+
+	return false
+}
+
+func rollupId(key rollupKey) string {
+	return key.Period + ":" + strconv.FormatInt(key.Start, 10) + ":" + key.Dimension + ":" + key.Value
+}
+
+func rollupPeriodStart(period string, timestamp int64) int64 {
+	size := statsIntervals[period]
+
+	return timestamp - timestamp%size
+}
+
+func rollupDimensionValue(dimension string, p *particle) string {
+	switch dimension {
+	case "event":
+		return p.Event
+	case "domain":
+		return p.Domain
+	case "path":
+		return p.Path
+	case "campaign":
+		return particleCampaign(p)
+	}
+
+	return ""
+}
+
+func setupRollupsCollection(session *mgo.Session, s *site) error {
+	sessionCopy := session.Copy()
+	defer sessionCopy.Close()
+
+	rollupCollection := s.Collection(sessionCopy, rollupCollectionName)
+
+	return rollupCollection.EnsureIndexKey("period", "dimension", "start")
+}
+
+func (c *rollupCounter) Add(p *particle) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for _, period := range rollupPeriods {
+		start := rollupPeriodStart(period, p.Timestamp)
+
+		for _, dimension := range rollupDimensions {
+			value := rollupDimensionValue(dimension, p)
+
+			if len(value) == 0 {
+				continue
+			}
+
+			c.counts[rollupKey{period, start, dimension, value}]++
+		}
+	}
+}
+
+// Write the counts to the rollups collection.  Counts that can't be written
+// are kept for the next flush.
+func (c *rollupCounter) Flush(session *mgo.Session, s *site) error {
+	c.mutex.Lock()
+	counts := c.counts
+	c.counts = make(map[rollupKey]int64)
+	c.mutex.Unlock()
+
+	if len(counts) == 0 {
+		return nil
+	}
+
+	sessionCopy := session.Copy()
+	defer sessionCopy.Close()
+
+	rollupCollection := s.Collection(sessionCopy, rollupCollectionName)
+
+	var err error
+
+	for key, count := range counts {
+		_, err = rollupCollection.UpsertId(rollupId(key), bson.M{
+			"$set": bson.M{"period": key.Period, "start": key.Start, "dimension": key.Dimension, "value": key.Value},
+			"$inc": bson.M{"particles": count},
+		})
+
+		if err != nil {
+			break
+		}
+
+		delete(counts, key)
+	}
+
+	if len(counts) > 0 {
+		c.mutex.Lock()
+		for key, count := range counts {
+			c.counts[key] += count
+		}
+		c.mutex.Unlock()
+	}
+
+	return err
+}
+
+func flushSitesRollups(session *mgo.Session, sites *siteRouter) {
+	for _, s := range sites.Sites() {
+		if err := s.rollups.Flush(session, s); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// The aggregation expression for a dimension's value.
+func rollupDimensionExpression(dimension string) interface{} {
+	if dimension != "campaign" {
+		return "$" + dimension
+	}
+
+	var parts []interface{}
+
+	// utm values are always saved as strings, but anything else ( or a
+	// missing value ) is joined as "" - like particleCampaign does - rather
+	// than failing the $concat.
+	for i, key := range sessionCampaignKeys {
+		if i > 0 {
+			parts = append(parts, "/")
+		}
+		parts = append(parts, bson.M{"$cond": []interface{}{
+			bson.M{"$eq": []interface{}{bson.M{"$type": "$data." + key}, "string"}},
+			"$data." + key,
+			"",
+		}})
+	}
+
+	return bson.M{"$concat": parts}
+}
+
+// Replace the rollups from since onwards with counts from the particles
+// collection.  since is rounded down to the start of its day.  Tetryon
+// should not be collecting for the site while this runs, or its particles
+// will be counted twice.
+func RebuildRollups(session *mgo.Session, s *site, since time.Time) error {
+	sessionCopy := session.Copy()
+	defer sessionCopy.Close()
+
+	particleCollection := s.Collection(sessionCopy, particleCollectionName)
+	rollupCollection := s.Collection(sessionCopy, rollupCollectionName)
+
+	from := rollupPeriodStart("day", since.Unix())
+
+	if _, err := rollupCollection.RemoveAll(bson.M{"start": bson.M{"$gte": from}}); err != nil {
+		return err
+	}
+
+	// No campaign is "//" when built from the joined utm values.
+	emptyValues := []interface{}{nil, "", "//"}
+
+	for _, period := range rollupPeriods {
+		size := statsIntervals[period]
+
+		for _, dimension := range rollupDimensions {
+			pipeline := []bson.M{
+				{"$match": bson.M{"timestamp": bson.M{"$gte": from}}},
+				{"$group": bson.M{
+					"_id": bson.M{
+						"start": bson.M{"$subtract": []interface{}{"$timestamp", bson.M{"$mod": []interface{}{"$timestamp", size}}}},
+						"value": rollupDimensionExpression(dimension),
+					},
+					"particles": bson.M{"$sum": 1},
+				}},
+				{"$match": bson.M{"_id.value": bson.M{"$nin": emptyValues}}},
+			}
+
+			var result struct {
+				Id struct {
+					Start int64  `bson:"start"`
+					Value string `bson:"value"`
+				} `bson:"_id"`
+				Particles int64 `bson:"particles"`
+			}
+
+			iter := particleCollection.Pipe(pipeline).AllowDiskUse().Iter()
+
+			for iter.Next(&result) {
+				key := rollupKey{period, result.Id.Start, dimension, result.Id.Value}
+
+				_, err := rollupCollection.UpsertId(rollupId(key), bson.M{
+					"$set": bson.M{"period": period, "start": key.Start, "dimension": dimension, "value": key.Value, "particles": result.Particles},
+				})
+
+				if err != nil {
+					iter.Close()
+					return err
+				}
+			}
+
+			if err := iter.Close(); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Read stats from rollups rather than particles.  Rollups can't be filtered
+// by event.  Unique beams are estimated from the uniques sketches, where there
+// are sketches for the dimension; there are no unique identifiers.
+func GetRollupStats(session *mgo.Session, s *site, q *statsQuery) ([]statsBucket, error) {
+	sessionCopy := session.Copy()
+	defer sessionCopy.Close()
+
+	rollupCollection := s.Collection(sessionCopy, rollupCollectionName)
+
+	dimension := q.GroupBy
+	if len(dimension) == 0 {
+		// Every particle has exactly one event, so summing them counts each once.
+		dimension = "event"
+	}
+
+	var rollups []rollup
+
+	err := rollupCollection.Find(bson.M{
+		"period":    q.Interval,
+		"dimension": dimension,
+		"start":     bson.M{"$gte": rollupPeriodStart(q.Interval, q.From), "$lt": q.To},
+	}).Sort("start", "value").All(&rollups)
+
+	if err != nil {
+		return nil, err
+	}
+
+	buckets := []statsBucket{}
+
+	for _, r := range rollups {
+		if len(q.GroupBy) > 0 {
+			buckets = append(buckets, statsBucket{Start: r.Start, Group: r.Value, Particles: r.Particles})
+			continue
+		}
+
+		if len(buckets) > 0 && buckets[len(buckets)-1].Start == r.Start {
+			buckets[len(buckets)-1].Particles += r.Particles
+		} else {
+			buckets = append(buckets, statsBucket{Start: r.Start, Particles: r.Particles})
+		}
+	}
+
+	uniqueDimension := q.GroupBy
+	if len(uniqueDimension) == 0 {
+		uniqueDimension = uniqueDimensionAll
+	}
+
+	if !q.Uniques || !validUniqueDimension(uniqueDimension) {
+		return buckets, nil
+	}
+
+	sketches, err := GetUniqueSketches(session, s, q.Interval, uniqueDimension, nil, q.From, q.To)
+
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range buckets {
+		value, _ := buckets[i].Group.(string)
+
+		if sketch, ok := sketches[rollupKey{q.Interval, buckets[i].Start, uniqueDimension, value}]; ok {
+			buckets[i].Beams = sketch.Estimate()
+		}
+	}
+
+	return buckets, nil
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+	"unicode/utf8"
+)
+
+// Schema modes.  enforce drops particles that fail validation, warn saves
+// them with their schema_errors and off skips validation entirely.
+const (
+	schemaModeEnforce = "enforce"
+	schemaModeWarn    = "warn"
+	schemaModeOff     = "off"
+)
+
+// Types a data value can be validated as.
+const (
+	schemaTypeString = valueTypeString
+	schemaTypeInt    = valueTypeInt
+	schemaTypeFloat  = valueTypeFloat
+	schemaTypeBool   = valueTypeBool
+	schemaTypeTime   = valueTypeTime
+	schemaTypeObject = valueTypeObject
+	schemaTypeArray  = valueTypeArray
+	schemaTypeEnum   = "enum"
+	schemaTypeRegex  = "regex"
+)
+
+const defaultSchemaLogSampleRate = 0.01
+
+// One file per event in the schemas directory, i.e. schemas/purchase.json:
+//
+//	{
+//	  "event": "purchase",
+//	  "mode": "enforce",
+//	  "keys": {
+//	    "quantity": { "type": "int", "required": true },
+//	    "currency": { "type": "enum", "values": ["USD", "EUR"] },
+//	    "sku": { "type": "regex", "pattern": "^[A-Z0-9-]+$", "max_length": 32 }
+//	  }
+//	}
+//
+// Keys that are not listed are violations unless allow_unknown is set.
+type eventSchema struct {
+	Event        string                `json:"event"`
+	Mode         string                `json:"mode"`
+	AllowUnknown bool                  `json:"allow_unknown"`
+	Keys         map[string]*schemaKey `json:"keys"`
+}
+
+type schemaKey struct {
+	Type      string   `json:"type"`
+	Required  bool     `json:"required"`
+	Values    []string `json:"values"`
+	Pattern   string   `json:"pattern"`
+	MaxLength int      `json:"max_length"`
+	regexp    *regexp.Regexp
+}
+
+type schemaRegistry struct {
+	schemas       map[string]*eventSchema
+	logSampleRate float64
+	violations    map[string]int64
+	mutex         sync.Mutex
+}
+
+func loadSchemaRegistry(schemaConfig SchemaConfig) (*schemaRegistry, error) {
+	registry := &schemaRegistry{
+		schemas:       make(map[string]*eventSchema),
+		logSampleRate: schemaConfig.LogSampleRate,
+		violations:    make(map[string]int64),
+	}
+
+	if registry.logSampleRate <= 0 {
+		registry.logSampleRate = defaultSchemaLogSampleRate
+	}
+
+	if len(schemaConfig.Path) == 0 {
+		return registry, nil
+	}
+
+	schemaFiles, err := filepath.Glob(filepath.Join(schemaConfig.Path, "*.json"))
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _, schemaFile := range schemaFiles {
+		schema, err := loadEventSchema(schemaFile)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if _, ok := registry.schemas[schema.Event]; ok {
+			return nil, fmt.Errorf("Schema error: %s: duplicate schema for event %s", schemaFile, schema.Event)
+		}
+
+		registry.schemas[schema.Event] = schema
+	}
+
+	return registry, nil
+}
+
+func loadEventSchema(schemaFile string) (*eventSchema, error) {
+	schemaData, err := ioutil.ReadFile(schemaFile)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var schema eventSchema
+	if err = json.Unmarshal(schemaData, &schema); err != nil {
+		return nil, fmt.Errorf("Schema error: %s: %s", schemaFile, err)
+	}
+
+	if len(schema.Event) == 0 {
+		return nil, fmt.Errorf("Schema error: %s: missing event", schemaFile)
+	}
+
+	if len(schema.Mode) == 0 {
+		schema.Mode = schemaModeEnforce
+	}
+
+	if schema.Mode != schemaModeEnforce && schema.Mode != schemaModeWarn && schema.Mode != schemaModeOff {
+		return nil, fmt.Errorf("Schema error: %s: invalid mode %s", schemaFile, schema.Mode)
+	}
+
+	for name, key := range schema.Keys {
+		if len(key.Type) == 0 {
+			key.Type = schemaTypeString
+		}
+
+		switch key.Type {
+		case schemaTypeString, schemaTypeInt, schemaTypeFloat, schemaTypeBool, schemaTypeTime, schemaTypeObject, schemaTypeArray:
+		case schemaTypeEnum:
+			if len(key.Values) == 0 {
+				return nil, fmt.Errorf("Schema error: %s: %s: enum without values", schemaFile, name)
+			}
+		case schemaTypeRegex:
+			if key.regexp, err = regexp.Compile(key.Pattern); err != nil {
+				return nil, fmt.Errorf("Schema error: %s: %s: %s", schemaFile, name, err)
+			}
+		default:
+			return nil, fmt.Errorf("Schema error: %s: %s: invalid type %s", schemaFile, name, key.Type)
+		}
+	}
+
+	return &schema, nil
+}
+
+// Validate a particle against the schema for its event, recording any
+// violations on it.  Returns false if the particle must be dropped.
+func (r *schemaRegistry) Validate(p *particle) bool {
+	schema, ok := r.schemas[p.Event]
+
+	if !ok || schema.Mode == schemaModeOff {
+		return true
+	}
+
+	violations := schema.violations(p.Data)
+
+	if len(violations) == 0 {
+		return true
+	}
+
+	r.mutex.Lock()
+	r.violations[p.Event] += int64(len(violations))
+	r.mutex.Unlock()
+
+	if rand.Float64() < r.logSampleRate {
+		log.Printf("Schema violations ( %s, %s ): %v", p.Event, schema.Mode, violations)
+	}
+
+	if schema.Mode == schemaModeEnforce {
+		return false
+	}
+
+	p.SchemaErrors = violations
+
+	return true
+}
+
+func (s *eventSchema) violations(data map[string]interface{}) []string {
+	var violations []string
+
+	for name, key := range s.Keys {
+		value, ok := data[name]
+
+		if !ok {
+			if key.Required {
+				violations = append(violations, name+": missing")
+			}
+			continue
+		}
+
+		if reason := key.check(value); len(reason) > 0 {
+			violations = append(violations, name+": "+reason)
+		}
+	}
+
+	if !s.AllowUnknown {
+		for name := range data {
+			if _, ok := s.Keys[name]; !ok {
+				violations = append(violations, name+": unknown key")
+			}
+		}
+	}
+
+	sort.Strings(violations)
+
+	return violations
+}
+
+func (k *schemaKey) check(data interface{}) string {
+	value, ok := data.(string)
+
+	// Typed by its key suffix, or nested, already.
+	if !ok {
+		if typedValueIs(k.Type, data) {
+			return ""
+		}
+		return "not a valid " + k.Type
+	}
+
+	if k.MaxLength > 0 && utf8.RuneCountInString(value) > k.MaxLength {
+		return "longer than " + strconv.Itoa(k.MaxLength)
+	}
+
+	var err error
+
+	switch k.Type {
+	case schemaTypeInt, schemaTypeFloat, schemaTypeBool, schemaTypeTime:
+		_, err = parseTypedValue(k.Type, value)
+	case schemaTypeObject, schemaTypeArray:
+		return "not a valid " + k.Type
+	case schemaTypeEnum:
+		for _, allowed := range k.Values {
+			if value == allowed {
+				return ""
+			}
+		}
+		return "not one of " + fmt.Sprint(k.Values)
+	case schemaTypeRegex:
+		if !k.regexp.MatchString(value) {
+			return "does not match " + k.Pattern
+		}
+	}
+
+	if err != nil {
+		return "not a valid " + k.Type
+	}
+
+	return ""
+}
+
+// Convert string values to the type given by the schema for their event.
+// Values that don't parse ( in warn mode ) are kept as strings.
+func (r *schemaRegistry) ApplyTypes(p *particle) {
+	schema, ok := r.schemas[p.Event]
+
+	if !ok {
+		return
+	}
+
+	for name, key := range schema.Keys {
+		value, ok := p.Data[name].(string)
+
+		if !ok || untypedDataKey(name) {
+			continue
+		}
+
+		switch key.Type {
+		case schemaTypeInt, schemaTypeFloat, schemaTypeBool, schemaTypeTime:
+			if typed, err := parseTypedValue(key.Type, value); err == nil {
+				p.Data[name] = typed
+			}
+		}
+	}
+}
+
+func logSchemaViolations(r *schemaRegistry) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	events := make([]string, 0, len(r.violations))
+	for event := range r.violations {
+		events = append(events, event)
+	}
+	sort.Strings(events)
+
+	for _, event := range events {
+		log.Printf("Schema violations ( %s ): %d", event, r.violations[event])
+	}
+}
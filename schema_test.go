@@ -0,0 +1,25 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestSchemaKeyMaxLength(t *testing.T) {
+	k := &schemaKey{Type: schemaTypeString, MaxLength: 4}
+
+	tests := []struct {
+		value     string
+		violation bool
+	}{
+		{"abcd", false},
+		{"abcde", true},
+		{"éèêë", false},
+		{"日本語です", true},
+	}
+
+	for _, test := range tests {
+		if violation := k.check(test.value); (len(violation) > 0) != test.violation {
+			t.Errorf("%q: check = %q, want violation %v", test.value, violation, test.violation)
+		}
+	}
+}
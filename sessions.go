@@ -0,0 +1,247 @@
+package main
+
+import (
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"log"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	sessionCollectionName = "sessions"
+)
+
+const defaultSessionInactivityTimeout = 1800
+
+const sessionSweepIntervalSeconds = 60
+
+// Data keys that start a new session when they change.  referer is added to
+// visit particles by the client.
+const (
+	sessionReferrerKey = "referer"
+)
+
+var sessionCampaignKeys = []string{"utm_source", "utm_medium", "utm_campaign"}
+
+// A session is a run of particles from one beam, ended by inactivity or by
+// the beam arriving from a new campaign or referrer.  Times are unix seconds,
+// like particle timestamps.
+type beamSession struct {
+	Id        string `bson:"_id" json:"id"`
+	BeamId    string `bson:"beam_id" json:"beam_id"`
+	Start     int64  `bson:"start" json:"start"`
+	End       int64  `bson:"end" json:"end"`
+	Duration  int64  `bson:"duration" json:"duration"`
+	EntryPath string `bson:"entry_path" json:"entry_path"`
+	ExitPath  string `bson:"exit_path" json:"exit_path"`
+	Referrer  string `bson:"referrer,omitempty" json:"referrer,omitempty"`
+	Campaign  string `bson:"campaign,omitempty" json:"campaign,omitempty"`
+	Particles int64  `bson:"particles" json:"particles"`
+}
+
+// Assigns particles to sessions.  The last session of each recently active
+// beam is kept in memory; beams that aren't are looked up in the sessions
+// collection, i.e. after a restart.
+type sessionizer struct {
+	timeout int64
+	active  map[string]*beamSession
+	mutex   sync.Mutex
+}
+
+func loadSessionizer(sessionConfig SessionConfig) *sessionizer {
+	return &sessionizer{
+		timeout: int64(sessionConfig.InactivityTimeout),
+		active:  make(map[string]*beamSession),
+	}
+}
+
+func setupSessionsCollection(session *mgo.Session, s *site) error {
+	sessionCopy := session.Copy()
+	defer sessionCopy.Close()
+
+	sessionCollection := s.Collection(sessionCopy, sessionCollectionName)
+
+	if err := sessionCollection.EnsureIndexKey("beam_id", "-end"); err != nil {
+		return err
+	}
+
+	return sessionCollection.EnsureIndexKey("start")
+}
+
+// Set the session ID of a particle, starting a new session or extending the
+// beam's current one.
+func (z *sessionizer) Assign(p *particle, session *mgo.Session, s *site) error {
+	var err error
+
+	key := s.Id + ":" + p.BeamId
+
+	z.mutex.Lock()
+	current := z.active[key]
+	z.mutex.Unlock()
+
+	if current == nil {
+		current, err = GetLatestSession(p.BeamId, session, s)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	campaign := particleCampaign(p)
+	referrer := externalReferrer(p)
+
+	if current == nil ||
+		p.Timestamp-current.End > z.timeout ||
+		(len(campaign) > 0 && campaign != current.Campaign) ||
+		(len(referrer) > 0 && referrer != current.Referrer) {
+		current = &beamSession{
+			Id:        bson.NewObjectId().Hex(),
+			BeamId:    p.BeamId,
+			Start:     p.Timestamp,
+			End:       p.Timestamp,
+			EntryPath: p.Path,
+			ExitPath:  p.Path,
+			Referrer:  referrer,
+			Campaign:  campaign,
+			Particles: 1,
+		}
+
+		err = current.Save(session, s)
+	} else {
+		err = current.Extend(p, session, s)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	p.SessionId = current.Id
+
+	z.mutex.Lock()
+	z.active[key] = current
+	z.mutex.Unlock()
+
+	return nil
+}
+
+// Forget sessions that have been inactive for longer than the timeout.  Their
+// next particle starts a new session anyway.
+func (z *sessionizer) Sweep(now time.Time) {
+	z.mutex.Lock()
+	defer z.mutex.Unlock()
+
+	for key, current := range z.active {
+		if now.Unix()-current.End > z.timeout {
+			delete(z.active, key)
+		}
+	}
+}
+
+func (z *sessionizer) Active() int {
+	z.mutex.Lock()
+	defer z.mutex.Unlock()
+
+	return len(z.active)
+}
+
+func (b *beamSession) Save(session *mgo.Session, s *site) error {
+	sessionCopy := session.Copy()
+	defer sessionCopy.Close()
+
+	sessionCollection := s.Collection(sessionCopy, sessionCollectionName)
+
+	return sessionCollection.Insert(b)
+}
+
+// Add a particle to the end of the session.
+func (b *beamSession) Extend(p *particle, session *mgo.Session, s *site) error {
+	if p.Timestamp > b.End {
+		b.End = p.Timestamp
+	}
+	b.Duration = b.End - b.Start
+	b.ExitPath = p.Path
+	b.Particles++
+
+	sessionCopy := session.Copy()
+	defer sessionCopy.Close()
+
+	sessionCollection := s.Collection(sessionCopy, sessionCollectionName)
+
+	return sessionCollection.UpdateId(b.Id, bson.M{
+		"$set": bson.M{"end": b.End, "duration": b.Duration, "exit_path": b.ExitPath},
+		"$inc": bson.M{"particles": 1},
+	})
+}
+
+// The most recent session for a beam, or nil if it has none.
+func GetLatestSession(beamId string, session *mgo.Session, s *site) (*beamSession, error) {
+	sessionCopy := session.Copy()
+	defer sessionCopy.Close()
+
+	sessionCollection := s.Collection(sessionCopy, sessionCollectionName)
+
+	b := &beamSession{}
+	err := sessionCollection.Find(bson.M{"beam_id": beamId}).Sort("-end").One(b)
+
+	if err == mgo.ErrNotFound {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return b, nil
+}
+
+// The utm values of a particle, joined, i.e. "google/cpc/spring".  Empty if
+// it has none.
+func particleCampaign(p *particle) string {
+	var values []string
+	found := false
+
+	for _, key := range sessionCampaignKeys {
+		value, _ := p.Data[key].(string)
+		values = append(values, value)
+
+		if len(value) > 0 {
+			found = true
+		}
+	}
+
+	if !found {
+		return ""
+	}
+
+	return strings.Join(values, "/")
+}
+
+// The host of a particle's referrer, if it is not the particle's own domain.
+func externalReferrer(p *particle) string {
+	referrer, _ := p.Data[sessionReferrerKey].(string)
+
+	if len(referrer) == 0 {
+		return ""
+	}
+
+	u, err := url.Parse(referrer)
+
+	if err != nil || len(u.Host) == 0 {
+		return ""
+	}
+
+	host := strings.ToLower(stripPort(u.Host))
+
+	if host == strings.ToLower(stripPort(p.Domain)) {
+		return ""
+	}
+
+	return host
+}
+
+func logActiveSessions(z *sessionizer) {
+	log.Printf("Active sessions: %d", z.Active())
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultNonceWindowSeconds = 300
+
+const signatureHeader = "X-Tetryon-Signature"
+
+// Verification results, counted and logged periodically.
+const (
+	signatureValid    = "valid"
+	signatureUnsigned = "unsigned"
+	signatureInvalid  = "invalid"
+	signatureExpired  = "expired"
+	signatureReplayed = "replayed"
+)
+
+// Parameters added by the server ( or used to carry the signature itself )
+// that are not part of the signed payload.
+var unsignedParams = map[string]bool{
+	paramsTypeKey:   true,
+	paramRequestId:  true,
+	paramUserAgent:  true,
+	paramClientIp:   true,
+	paramQuarantine: true,
+	paramSite:       true,
+	paramSig:        true,
+	paramSigned:     true,
+}
+
+// Verifies HMAC-SHA256 signatures on reassembled particle requests, with the
+// secret of the site they were routed to.  Each signed request must carry a
+// timestamp and a nonce; requests outside the window or reusing a nonce
+// ( for their site ) are rejected.
+type requestVerifier struct {
+	window     time.Duration
+	nonces     map[string]time.Time
+	lastPruned time.Time
+	counts     map[string]int64
+	mutex      sync.Mutex
+}
+
+func loadRequestVerifier(signingConfig SigningConfig) *requestVerifier {
+	window := signingConfig.NonceWindowSeconds
+	if window <= 0 {
+		window = defaultNonceWindowSeconds
+	}
+
+	return &requestVerifier{
+		window:     time.Duration(window) * time.Second,
+		nonces:     make(map[string]time.Time),
+		lastPruned: time.Now(),
+		counts:     make(map[string]int64),
+	}
+}
+
+// The canonical form of a request is every signed parameter, sorted by key,
+// query-escaped and joined as key=value pairs with "&".
+func canonicalParams(params map[string]string) string {
+	keys := make([]string, 0, len(params))
+	for key := range params {
+		if !unsignedParams[key] {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	pairs := make([]string, len(keys))
+	for i, key := range keys {
+		pairs[i] = url.QueryEscape(key) + "=" + url.QueryEscape(params[key])
+	}
+
+	return strings.Join(pairs, "&")
+}
+
+func signParams(secret string, params map[string]string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(canonicalParams(params)))
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify a reassembled request for site s, recording the result in
+// paramSigned.  Returns false if the request must be rejected.
+func (v *requestVerifier) Verify(params map[string]string, s *site) bool {
+	result := v.verify(params, s)
+
+	v.mutex.Lock()
+	v.counts[result]++
+	v.mutex.Unlock()
+
+	params[paramSigned] = strconv.FormatBool(result == signatureValid)
+
+	if result == signatureUnsigned {
+		return !s.signing.Require
+	}
+
+	return result == signatureValid
+}
+
+func (v *requestVerifier) verify(params map[string]string, s *site) string {
+	sig, ok := params[paramSig]
+
+	if !ok {
+		return signatureUnsigned
+	}
+
+	if len(s.signing.Secret) == 0 {
+		return signatureInvalid
+	}
+
+	if !hmac.Equal([]byte(strings.ToLower(sig)), []byte(signParams(s.signing.Secret, params))) {
+		return signatureInvalid
+	}
+
+	timestamp, err := strconv.ParseInt(params[paramSigTimestamp], 10, 64)
+
+	if err != nil {
+		return signatureInvalid
+	}
+
+	now := time.Now()
+	signedAt := time.Unix(timestamp, 0)
+
+	if now.Sub(signedAt) > v.window || signedAt.Sub(now) > v.window {
+		return signatureExpired
+	}
+
+	nonce, ok := params[paramSigNonce]
+
+	if !ok || len(nonce) == 0 {
+		return signatureInvalid
+	}
+
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+
+	if now.Sub(v.lastPruned) > v.window {
+		for n, seen := range v.nonces {
+			if now.Sub(seen) > v.window {
+				delete(v.nonces, n)
+			}
+		}
+		v.lastPruned = now
+	}
+
+	nonce = s.Id + ":" + nonce
+
+	if seen, ok := v.nonces[nonce]; ok && now.Sub(seen) <= v.window {
+		return signatureReplayed
+	}
+
+	v.nonces[nonce] = now
+
+	return signatureValid
+}
+
+func logSignatureCounts(v *requestVerifier) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+
+	for _, result := range []string{signatureValid, signatureUnsigned, signatureInvalid, signatureExpired, signatureReplayed} {
+		log.Printf("Signed requests ( %s ): %d", result, v.counts[result])
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestCanonicalParams(t *testing.T) {
+	tests := []struct {
+		params map[string]string
+		want   string
+	}{
+		{map[string]string{}, ""},
+		{map[string]string{"b": "2", "a": "1"}, "a=1&b=2"},
+		{map[string]string{"a b": "x&y=z"}, "a+b=x%26y%3Dz"},
+		{
+			map[string]string{
+				"a":             "1",
+				paramRequestId:  "abc:1-1",
+				paramSig:        "00",
+				paramSigned:     "true",
+				paramUserAgent:  "Mozilla/5.0",
+				paramClientIp:   "127.0.0.1",
+				paramSite:       "shop",
+				paramQuarantine: "origin",
+				paramsTypeKey:   "particle",
+			},
+			"a=1",
+		},
+		{map[string]string{paramEvent: "visit", paramSigNonce: "n1"}, paramEvent + "=visit&" + paramSigNonce + "=n1"},
+	}
+
+	for _, test := range tests {
+		if got := canonicalParams(test.params); got != test.want {
+			t.Errorf("canonicalParams(%v) = %q, want %q", test.params, got, test.want)
+		}
+	}
+}
+
+func TestSignParams(t *testing.T) {
+	params := map[string]string{"a": "1", "b": "2"}
+
+	// echo -n "a=1&b=2" | openssl dgst -sha256 -hmac secret
+	want := "604fe97c66c6393ff22e3cae366eee1131e351ebc736bf12f5d62e1755b7a233"
+
+	if got := signParams("secret", params); got != want {
+		t.Errorf("signParams = %s, want %s", got, want)
+	}
+
+	params[paramSig] = want
+	params[paramRequestId] = "abc:1-1"
+
+	if got := signParams("secret", params); got != want {
+		t.Errorf("signParams changed with unsigned parameters: %s", got)
+	}
+
+	if got := signParams("other", params); got == want {
+		t.Error("signParams gave the same signature for another secret")
+	}
+}
+
+func TestVerify(t *testing.T) {
+	shop := &site{Id: "shop", signing: SigningKey{Secret: "secret", Require: true}}
+	outlet := &site{Id: "outlet", signing: SigningKey{Secret: "secret"}}
+	blog := &site{Id: "blog"}
+
+	signed := func(nonce string, timestamp int64) map[string]string {
+		params := map[string]string{
+			paramEvent:        "purchase",
+			paramSigNonce:     nonce,
+			paramSigTimestamp: strconv.FormatInt(timestamp, 10),
+		}
+		params[paramSig] = signParams("secret", params)
+		return params
+	}
+
+	now := time.Now().Unix()
+
+	tests := []struct {
+		name   string
+		params map[string]string
+		s      *site
+		ok     bool
+		signed string
+	}{
+		{"valid", signed("n1", now), shop, true, "true"},
+		{"replayed", signed("n1", now), shop, false, "false"},
+		{"same nonce for another site", signed("n1", now), outlet, true, "true"},
+		{"expired", signed("n2", now-3600), shop, false, "false"},
+		{"tampered", func() map[string]string { p := signed("n3", now); p[paramEvent] = "refund"; return p }(), shop, false, "false"},
+		{"unsigned but required", map[string]string{paramEvent: "visit"}, shop, false, "false"},
+		{"unsigned", map[string]string{paramEvent: "visit"}, blog, true, "false"},
+		{"signed for a site without a secret", signed("n4", now), blog, false, "false"},
+	}
+
+	v := loadRequestVerifier(SigningConfig{})
+
+	for _, test := range tests {
+		if ok := v.Verify(test.params, test.s); ok != test.ok {
+			t.Errorf("%s: Verify = %v, want %v", test.name, ok, test.ok)
+		}
+
+		if test.params[paramSigned] != test.signed {
+			t.Errorf("%s: %s = %s, want %s", test.name, paramSigned, test.params[paramSigned], test.signed)
+		}
+	}
+}
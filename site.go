@@ -0,0 +1,149 @@
+package main
+
+import (
+	"gopkg.in/mgo.v2"
+	"net/http"
+)
+
+const defaultSiteId = "default"
+
+// A site is one tenant of a Tetryon process.  Each site writes to its own
+// database, or to prefixed collections in a shared one.
+type site struct {
+	Id               string
+	Key              string
+	Database         string
+	CollectionPrefix string
+	domains          *domainAllowlist
+	quota            QuotaConfig
+	signing          SigningKey
+	usage            *siteUsage
+	rollups          *rollupCounter
+	uniques          *uniqueCounter
+}
+
+type siteRouter struct {
+	sites []*site
+	byId  map[string]*site
+	byKey map[string]*site
+}
+
+// Load the configured sites.  If there are none, a single default site is
+// created from the top level mongodb, domains, quota and signing
+// configuration.
+func loadSiteRouter(config *TetryonConfig) *siteRouter {
+	router := &siteRouter{
+		byId:  make(map[string]*site),
+		byKey: make(map[string]*site),
+	}
+
+	siteConfigs := config.SiteConfigs
+	node := uniquesNode(config.UniquesConfig)
+
+	if len(siteConfigs) == 0 {
+		siteConfigs = []SiteConfig{{
+			Id:          defaultSiteId,
+			Domains:     config.DomainConfig.Allowed,
+			Database:    config.MongoConfig.Database,
+			QuotaConfig: config.QuotaConfig,
+			Signing: SigningKey{
+				Secret:  config.SigningConfig.Secret,
+				Require: config.SigningConfig.Require,
+			},
+		}}
+	}
+
+	for _, siteConfig := range siteConfigs {
+		s := &site{
+			Id:               siteConfig.Id,
+			Key:              siteConfig.Key,
+			Database:         siteConfig.Database,
+			CollectionPrefix: siteConfig.CollectionPrefix,
+			quota:            siteConfig.QuotaConfig,
+			signing:          siteConfig.Signing,
+			rollups:          newRollupCounter(),
+			uniques:          newUniqueCounter(node),
+			domains: loadDomainAllowlist(DomainConfig{
+				Allowed: siteConfig.Domains,
+				Action:  config.DomainConfig.Action,
+			}),
+		}
+
+		router.sites = append(router.sites, s)
+		router.byId[s.Id] = s
+
+		if len(s.Key) > 0 {
+			router.byKey[s.Key] = s
+		}
+	}
+
+	return router
+}
+
+func (s *site) Collection(session *mgo.Session, name string) *mgo.Collection {
+	return session.DB(s.Database).C(s.CollectionPrefix + name)
+}
+
+// Create any collections and indexes a site needs.
+func setupSiteCollections(session *mgo.Session, s *site) error {
+	setups := []func(*mgo.Session, *site) error{
+		setupParticlesCollection,
+		setupParticleQueryIndexes,
+		setupBeamsCollection,
+		setupBotParticlesCollection,
+		setupQuarantinedParticlesCollection,
+		setupUsageCollection,
+		setupSessionsCollection,
+		setupIdentitiesCollection,
+		setupRollupsCollection,
+		setupUniquesCollection,
+		setupWebhookDeadLettersCollection,
+		setupLinkTokensCollection,
+	}
+
+	for _, setup := range setups {
+		if err := setup(session, s); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (r *siteRouter) Get(id string) (*site, bool) {
+	s, ok := r.byId[id]
+
+	return s, ok
+}
+
+func (r *siteRouter) Sites() []*site {
+	return r.sites
+}
+
+// Find the site a request belongs to: by its write key if it has one,
+// otherwise by its origin or domain.  A single site gets everything that
+// doesn't carry a key.
+func (r *siteRouter) Route(req *http.Request, params map[string]string) (*site, bool) {
+	if key, ok := params[paramSiteKey]; ok {
+		s, ok := r.byKey[key]
+		return s, ok
+	}
+
+	if len(r.sites) == 1 {
+		return r.sites[0], true
+	}
+
+	for _, host := range []string{requestOrigin(req), params[paramDomain]} {
+		if len(host) == 0 {
+			continue
+		}
+
+		for _, s := range r.sites {
+			if s.domains.Matches(host) {
+				return s, true
+			}
+		}
+	}
+
+	return nil, false
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Bucket sizes, in seconds.
+var statsIntervals = map[string]int64{
+	"minute": 60,
+	"hour":   3600,
+	"day":    86400,
+}
+
+const defaultStatsInterval = "hour"
+
+// Where stats are read from.
+const (
+	statsSourceParticles = "particles"
+	statsSourceRollups   = "rollups"
+)
+
+// Bounds the work of a single stats request.
+const maxStatsBuckets = 1440
+
+// What particles can be grouped by, besides a data key ( "data.<key>" ).
+var statsGroups = map[string]bool{
+	"event":  true,
+	"domain": true,
+	"path":   true,
+}
+
+var statsDataKeyPattern = regexp.MustCompile(`^data\.[A-Za-z0-9_-]+(\.[A-Za-z0-9_-]+)*$`)
+
+type statsQuery struct {
+	Source   string
+	Interval string
+	GroupBy  string
+	Event    string
+	Uniques  bool
+	From     int64
+	To       int64
+}
+
+// Counts for one bucket ( and group, if grouped ).  Start is the unix
+// timestamp the bucket starts at.  Unique counts are omitted when they aren't
+// available, or weren't asked for ( every bucket has at least one beam ).
+type statsBucket struct {
+	Start       int64       `bson:"start" json:"start"`
+	Group       interface{} `bson:"group,omitempty" json:"group,omitempty"`
+	Particles   int64       `bson:"particles" json:"particles"`
+	Beams       int64       `bson:"beams" json:"beams,omitempty"`
+	Identifiers int64       `bson:"identifiers" json:"identifiers,omitempty"`
+}
+
+// The from / to range of a request, defaulting to the last day.
+func parseQueryRange(r *http.Request) (int64, int64, error) {
+	from, err := parseQueryTimestamp(r, "from")
+
+	if err != nil {
+		return 0, 0, err
+	}
+
+	to, err := parseQueryTimestamp(r, "to")
+
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if to == 0 {
+		to = time.Now().Unix()
+	}
+
+	if from == 0 {
+		from = to - statsIntervals["day"]
+	}
+
+	if from >= to {
+		return 0, 0, errors.New("from must be before to")
+	}
+
+	return from, to, nil
+}
+
+// Defaults to the last day, in hours.
+func parseStatsQuery(r *http.Request) (*statsQuery, error) {
+	var err error
+
+	q := &statsQuery{
+		Source:   r.FormValue("source"),
+		Interval: r.FormValue("interval"),
+		GroupBy:  r.FormValue("group_by"),
+		Event:    r.FormValue("event"),
+		Uniques:  true,
+	}
+
+	if value := r.FormValue("uniques"); len(value) > 0 {
+		if q.Uniques, err = strconv.ParseBool(value); err != nil {
+			return nil, errors.New("invalid uniques: " + value)
+		}
+	}
+
+	if len(q.Interval) == 0 {
+		q.Interval = defaultStatsInterval
+	}
+
+	size, ok := statsIntervals[q.Interval]
+
+	if !ok {
+		return nil, errors.New("invalid interval: " + q.Interval)
+	}
+
+	switch q.Source {
+	case "", statsSourceParticles:
+		q.Source = statsSourceParticles
+
+		if len(q.GroupBy) > 0 && !statsGroups[q.GroupBy] && !statsDataKeyPattern.MatchString(q.GroupBy) {
+			return nil, errors.New("invalid group_by: " + q.GroupBy)
+		}
+	case statsSourceRollups:
+		if q.Interval == "minute" {
+			return nil, errors.New("rollups are hourly and daily")
+		}
+
+		if len(q.GroupBy) > 0 && !validRollupDimension(q.GroupBy) {
+			return nil, errors.New("invalid group_by for rollups: " + q.GroupBy)
+		}
+
+		if len(q.Event) > 0 {
+			return nil, errors.New("rollups can't be filtered by event")
+		}
+	default:
+		return nil, errors.New("invalid source: " + q.Source)
+	}
+
+	if q.From, q.To, err = parseQueryRange(r); err != nil {
+		return nil, err
+	}
+
+	if (q.To-q.From)/size > maxStatsBuckets {
+		return nil, errors.New("too many buckets, use a larger interval or a shorter range")
+	}
+
+	return q, nil
+}
+
+func (q *statsQuery) match() bson.M {
+	match := bson.M{"timestamp": bson.M{"$gte": q.From, "$lt": q.To}}
+	if len(q.Event) > 0 {
+		match["event"] = q.Event
+	}
+
+	return match
+}
+
+// The bucket ( and group ) of a particle, with any extra fields.
+func (q *statsQuery) bucketId(fields bson.M) bson.M {
+	size := statsIntervals[q.Interval]
+
+	id := bson.M{"start": bson.M{"$subtract": []interface{}{"$timestamp", bson.M{"$mod": []interface{}{"$timestamp", size}}}}}
+	if len(q.GroupBy) > 0 {
+		id["group"] = "$" + q.GroupBy
+	}
+
+	for name, value := range fields {
+		id[name] = value
+	}
+
+	return id
+}
+
+// Count particles per bucket.
+func (q *statsQuery) pipeline() []bson.M {
+	return []bson.M{
+		{"$match": q.match()},
+		{"$group": bson.M{
+			"_id":       q.bucketId(nil),
+			"particles": bson.M{"$sum": 1},
+		}},
+		{"$project": bson.M{
+			"_id":       0,
+			"start":     "$_id.start",
+			"group":     "$_id.group",
+			"particles": 1,
+		}},
+	}
+}
+
+// Count the distinct values of field per bucket, as count, by grouping
+// twice - first per value, then per bucket - so no bucket has to hold every
+// value at once.  Particles are summed along the way.
+func (q *statsQuery) uniquePipeline(field string, count string) []bson.M {
+	return []bson.M{
+		{"$match": q.match()},
+		{"$group": bson.M{
+			"_id":       q.bucketId(bson.M{"value": "$" + field}),
+			"particles": bson.M{"$sum": 1},
+		}},
+		{"$group": bson.M{
+			"_id":       bson.M{"start": "$_id.start", "group": "$_id.group"},
+			"particles": bson.M{"$sum": "$particles"},
+			count:       bson.M{"$sum": 1},
+		}},
+		{"$project": bson.M{
+			"_id":       0,
+			"start":     "$_id.start",
+			"group":     "$_id.group",
+			"particles": 1,
+			count:       1,
+		}},
+	}
+}
+
+// Count particles per bucket, with unique beams and identifiers unless the
+// query leaves them out.  Unique beams and identifiers are counted by
+// separate pipelines, then merged by bucket.
+func GetStats(session *mgo.Session, s *site, q *statsQuery) ([]statsBucket, error) {
+	sessionCopy := session.Copy()
+	defer sessionCopy.Close()
+
+	particleCollection := s.Collection(sessionCopy, particleCollectionName)
+
+	buckets := []statsBucket{}
+
+	if !q.Uniques {
+		err := particleCollection.Pipe(q.pipeline()).AllowDiskUse().All(&buckets)
+		sortStatsBuckets(buckets)
+		return buckets, err
+	}
+
+	err := particleCollection.Pipe(q.uniquePipeline("beam_id", "beams")).AllowDiskUse().All(&buckets)
+
+	if err != nil {
+		return nil, err
+	}
+
+	byKey := make(map[string]*statsBucket)
+
+	for i := range buckets {
+		byKey[statsBucketKey(buckets[i])] = &buckets[i]
+	}
+
+	var identifiers statsBucket
+
+	iter := particleCollection.Pipe(q.uniquePipeline("identifier", "identifiers")).AllowDiskUse().Iter()
+
+	for iter.Next(&identifiers) {
+		// Every bucket with particles has beams.
+		if b, ok := byKey[statsBucketKey(identifiers)]; ok {
+			b.Identifiers = identifiers.Identifiers
+		}
+		identifiers = statsBucket{}
+	}
+
+	if err = iter.Close(); err != nil {
+		return nil, err
+	}
+
+	sortStatsBuckets(buckets)
+
+	return buckets, nil
+}
+
+// Groups can be any value a data key holds, so buckets are matched by their
+// printed form.
+func statsBucketKey(b statsBucket) string {
+	return fmt.Sprintf("%d %#v", b.Start, b.Group)
+}
+
+// Order buckets by start, then by group as printed.
+func sortStatsBuckets(buckets []statsBucket) {
+	sort.SliceStable(buckets, func(i, j int) bool {
+		if buckets[i].Start != buckets[j].Start {
+			return buckets[i].Start < buckets[j].Start
+		}
+		return fmt.Sprint(buckets[i].Group) < fmt.Sprint(buckets[j].Group)
+	})
+}
+
+// GET /v1/stats?site=<id>&interval=<minute|hour|day>&group_by=<event|domain|path|data.key>
+// Optionally filter by event, and a from / to range ( the last day by
+// default ).  With source=rollups, stats are read from the rollups instead.
+func handleStatsRequest(session *mgo.Session, sites *siteRouter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			writeJsonError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+
+		s, status, err := adminSite(sites, r)
+
+		if err != nil {
+			writeJsonError(w, status, err.Error())
+			return
+		}
+
+		q, err := parseStatsQuery(r)
+
+		if err != nil {
+			writeJsonError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		var buckets []statsBucket
+
+		if q.Source == statsSourceRollups {
+			buckets, err = GetRollupStats(session, s, q)
+		} else {
+			buckets, err = GetStats(session, s, q)
+		}
+
+		if err != nil {
+			log.Println(err)
+			writeJsonError(w, http.StatusInternalServerError, "could not read stats")
+			return
+		}
+
+		writeJson(w, http.StatusOK, buckets)
+	}
+}
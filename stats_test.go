@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestParseStatsQueryUniques(t *testing.T) {
+	tests := []struct {
+		query   string
+		uniques bool
+		valid   bool
+	}{
+		{"", true, true},
+		{"uniques=true", true, true},
+		{"uniques=false", false, true},
+		{"uniques=maybe", false, false},
+	}
+
+	for _, test := range tests {
+		q, err := parseStatsQuery(httptest.NewRequest("GET", "/v1/stats?"+test.query, nil))
+
+		if (err == nil) != test.valid {
+			t.Errorf("%q: error = %v, want valid %v", test.query, err, test.valid)
+			continue
+		}
+
+		if err == nil && q.Uniques != test.uniques {
+			t.Errorf("%q: uniques = %v, want %v", test.query, q.Uniques, test.uniques)
+		}
+	}
+}
+
+func TestSortStatsBuckets(t *testing.T) {
+	buckets := []statsBucket{
+		{Start: 7200, Group: "visit"},
+		{Start: 3600, Group: "visit"},
+		{Start: 3600, Group: "purchase"},
+	}
+
+	sortStatsBuckets(buckets)
+
+	want := []statsBucket{
+		{Start: 3600, Group: "purchase"},
+		{Start: 3600, Group: "visit"},
+		{Start: 7200, Group: "visit"},
+	}
+
+	if !reflect.DeepEqual(buckets, want) {
+		t.Errorf("sortStatsBuckets = %v, want %v", buckets, want)
+	}
+
+	if statsBucketKey(statsBucket{Start: 1, Group: "1"}) == statsBucketKey(statsBucket{Start: 1, Group: int64(1)}) {
+		t.Error("buckets with a string and a number group have the same key")
+	}
+}
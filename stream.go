@@ -0,0 +1,199 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Particles buffered per subscriber.  When a subscriber's buffer is full new
+// particles are dropped for it rather than holding up ingestion.
+const streamBufferSize = 256
+
+// Comments are sent this often so idle connections aren't closed by proxies.
+const streamKeepaliveSeconds = 15
+
+const eventStreamContentType = "text/event-stream"
+
+// What a subscriber wants to see.  Empty fields match everything.
+type streamFilter struct {
+	Site   string
+	Event  string
+	Domain string
+	BeamId string
+}
+
+type streamSubscriber struct {
+	filter    streamFilter
+	particles chan *particle
+	dropped   int64
+}
+
+// Fans saved particles out to the subscribers of the stream API.
+type particleStream struct {
+	subscribers map[*streamSubscriber]bool
+	dropped     int64
+	mutex       sync.Mutex
+}
+
+func newParticleStream() *particleStream {
+	return &particleStream{
+		subscribers: make(map[*streamSubscriber]bool),
+	}
+}
+
+func (f *streamFilter) matches(siteId string, p *particle) bool {
+	return (len(f.Site) == 0 || f.Site == siteId) &&
+		(len(f.Event) == 0 || f.Event == p.Event) &&
+		(len(f.Domain) == 0 || f.Domain == p.Domain) &&
+		(len(f.BeamId) == 0 || f.BeamId == p.BeamId)
+}
+
+func (ps *particleStream) Subscribe(filter streamFilter) *streamSubscriber {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+
+	sub := &streamSubscriber{
+		filter:    filter,
+		particles: make(chan *particle, streamBufferSize),
+	}
+
+	ps.subscribers[sub] = true
+
+	return sub
+}
+
+func (ps *particleStream) Unsubscribe(sub *streamSubscriber) {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+
+	delete(ps.subscribers, sub)
+}
+
+// Send a saved particle to every matching subscriber, without blocking.
+// Particles must not be changed once published.
+func (ps *particleStream) Publish(siteId string, p *particle) {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+
+	for sub := range ps.subscribers {
+		if !sub.filter.matches(siteId, p) {
+			continue
+		}
+
+		select {
+		case sub.particles <- p:
+		default:
+			sub.dropped++
+			ps.dropped++
+		}
+	}
+}
+
+// How many particles have been dropped for a subscriber.
+func (ps *particleStream) DroppedFor(sub *streamSubscriber) int64 {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+
+	return sub.dropped
+}
+
+func (ps *particleStream) Subscribers() int {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+
+	return len(ps.subscribers)
+}
+
+func (ps *particleStream) Dropped() int64 {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+
+	return ps.dropped
+}
+
+func logStreamCounts(ps *particleStream) {
+	log.Printf("Stream subscribers: %d", ps.Subscribers())
+	log.Printf("Stream particles dropped: %d", ps.Dropped())
+}
+
+// GET /v1/stream?site=<id>&event=&domain=&beam_id=
+// Server-Sent Events: each saved particle that matches is sent as a
+// "particle" event with its JSON as data.  When particles have been dropped
+// because the client is reading too slowly, a "dropped" event is sent first
+// with the total dropped so far.
+func handleStreamRequest(sites *siteRouter, stream *particleStream) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			writeJsonError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+
+		s, status, err := adminSite(sites, r)
+
+		if err != nil {
+			writeJsonError(w, status, err.Error())
+			return
+		}
+
+		flusher, ok := w.(http.Flusher)
+
+		if !ok {
+			writeJsonError(w, http.StatusInternalServerError, "streaming not supported")
+			return
+		}
+
+		sub := stream.Subscribe(streamFilter{
+			Site:   s.Id,
+			Event:  r.FormValue("event"),
+			Domain: r.FormValue("domain"),
+			BeamId: r.FormValue("beam_id"),
+		})
+		defer stream.Unsubscribe(sub)
+
+		w.Header().Set("Content-Type", eventStreamContentType)
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("X-Accel-Buffering", "no")
+		w.WriteHeader(http.StatusOK)
+		flusher.Flush()
+
+		keepalive := time.NewTicker(streamKeepaliveSeconds * time.Second)
+		defer keepalive.Stop()
+
+		var reported int64
+
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-keepalive.C:
+				if _, err = fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+					return
+				}
+			case p := <-sub.particles:
+				if dropped := stream.DroppedFor(sub); dropped > reported {
+					reported = dropped
+					if _, err = fmt.Fprintf(w, "event: dropped\ndata: {\"dropped\":%d}\n\n", dropped); err != nil {
+						return
+					}
+				}
+
+				data, err := json.Marshal(p)
+
+				if err != nil {
+					log.Println(err)
+					continue
+				}
+
+				if _, err = fmt.Fprintf(w, "id: %s\nevent: particle\ndata: %s\n\n", p.Id.Hex(), data); err != nil {
+					return
+				}
+			}
+
+			flusher.Flush()
+		}
+	}
+}
@@ -36,13 +36,31 @@ func main() {
 	var httpServeMux *http.ServeMux
 	var requestParamChannel chan map[string]string
 	var requestReceivedChannel chan request
+	var uaParser *userAgentParser
+	var bots *botFilter
+	var limiter *requestLimiter
+	var sites *siteRouter
+	var verifier *requestVerifier
+	var schemas *schemaRegistry
+	var limits *paramLimits
+	var sessions *sessionizer
+	var linker *beamLinker
+	var stream *particleStream
+	var webhooks *webhookDispatcher
+	var admitter *requestAdmitter
 	var requestsHandled int64 = 0
+	var requestsExpired int64 = 0
 	var mutex = &sync.Mutex{}
 
 	log.SetPrefix("Tetryon ")
 
 	var configPath string
 	flag.StringVar(&configPath, "configpath", "./config", "Path to configuration.")
+
+	var rebuildRollups bool
+	var rebuildSince string
+	flag.BoolVar(&rebuildRollups, "rebuildrollups", false, "Rebuild rollups from particles for every site, then exit.")
+	flag.StringVar(&rebuildSince, "rebuildsince", "1970-01-01", "Day ( YYYY-MM-DD ) to rebuild rollups from.")
 	flag.Parse()
 
 	if responseGifData, err = loadResponseGif(transparent1x1Gif); err != nil {
@@ -53,18 +71,63 @@ func main() {
 		log.Fatal(err)
 	}
 
-	if mongoSession, err = loadMongoSession(tetryonConfig.MongoConfig); err != nil {
+	if uaParser, err = loadUserAgentParser(tetryonConfig.UserAgentConfig); err != nil {
 		log.Fatal(err)
 	}
 
-	if err = setupParticlesCollection(mongoSession, tetryonConfig); err != nil {
+	if bots, err = loadBotFilter(tetryonConfig.BotConfig); err != nil {
 		log.Fatal(err)
 	}
 
-	if err = setupBeamsCollection(mongoSession, tetryonConfig); err != nil {
+	if schemas, err = loadSchemaRegistry(tetryonConfig.SchemaConfig); err != nil {
+		log.Fatal(err)
+	}
+
+	limiter = loadRequestLimiter(tetryonConfig.RateLimitConfig)
+	sites = loadSiteRouter(tetryonConfig)
+	verifier = loadRequestVerifier(tetryonConfig.SigningConfig)
+	limits = loadParamLimits(tetryonConfig.LimitsConfig)
+	sessions = loadSessionizer(tetryonConfig.SessionConfig)
+	linker = loadBeamLinker(tetryonConfig.LinkingConfig)
+	stream = newParticleStream()
+	webhooks = loadWebhookDispatcher(tetryonConfig.WebhookConfigs)
+	admitter = newRequestAdmitter(sites, limiter, limits.MaxParts())
+
+	if mongoSession, err = loadMongoSession(tetryonConfig.MongoConfig); err != nil {
 		log.Fatal(err)
 	}
 
+	for _, s := range sites.Sites() {
+		if err = setupSiteCollections(mongoSession, s); err != nil {
+			log.Fatal(err)
+		}
+
+		if err = loadSiteUsage(mongoSession, s); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if rebuildRollups {
+		since, err := time.Parse("2006-01-02", rebuildSince)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		node := uniquesNode(tetryonConfig.UniquesConfig)
+
+		for _, s := range sites.Sites() {
+			if err = RebuildRollups(mongoSession, s, since); err != nil {
+				log.Fatal(err)
+			}
+			if err = RebuildUniques(mongoSession, s, since, node); err != nil {
+				log.Fatal(err)
+			}
+			log.Println("Rebuilt rollups for site: " + s.Id)
+		}
+
+		return
+	}
+
 	if requestReceivedChannel, err = loadRequestReceivedChannel(mongoSession, tetryonConfig); err != nil {
 		log.Fatal(err)
 	}
@@ -73,11 +136,27 @@ func main() {
 		log.Fatal(err)
 	}
 
+	webhooks.Start(mongoSession)
+
+	receivedPipeline := &pipeline{
+		session:  mongoSession,
+		sites:    sites,
+		uaParser: uaParser,
+		bots:     bots,
+		schemas:  schemas,
+		sessions: sessions,
+		stream:   stream,
+		webhooks: webhooks,
+		limits:   limits,
+	}
+
 	// for i := 0; i < 10; i++ {
 	go func() {
 		for receivedRequest := range requestReceivedChannel {
 			requestsHandled++
-			handleReceivedRequest(receivedRequest, mongoSession, tetryonConfig)
+			if err := handleReceivedRequest(receivedRequest, receivedPipeline); err != nil {
+				log.Println(err)
+			}
 		}
 	}()
 	// }
@@ -87,14 +166,17 @@ func main() {
 	// for j := 0; j < 10; j++ {
 	go func() {
 		for parameters := range requestParamChannel {
-			handleRequestParameters(parameters, activeRequests, requestReceivedChannel, mutex)
+			handleRequestParameters(parameters, activeRequests, requestReceivedChannel, mutex, sites, verifier, limits)
 		}
 	}()
 	// }
 
 	httpServeMux = http.NewServeMux()
-	httpServeMux.HandleFunc("/beam", handleBeamRequest(responseGifData, requestParamChannel))
-	httpServeMux.HandleFunc("/particle", handleParticleRequest(responseGifData, requestParamChannel))
+	httpServeMux.HandleFunc("/beam", handleBeamRequest(responseGifData, requestParamChannel, admitter))
+	httpServeMux.HandleFunc("/particle", handleParticleRequest(responseGifData, requestParamChannel, admitter))
+	if len(tetryonConfig.LinkingConfig.Secret) > 0 {
+		httpServeMux.HandleFunc("/link", limitRequests(limiter, responseGifData, handleLinkRequest(mongoSession, sites, linker)))
+	}
 	httpServeMux.HandleFunc("/", http.NotFound)
 
 	go func() {
@@ -115,10 +197,32 @@ func main() {
 		}
 	}()
 
+	if len(tetryonConfig.AdminConfig.Port) > 0 {
+		adminServeMux := http.NewServeMux()
+		adminServeMux.HandleFunc("/v1/usage", requireAdminToken(tetryonConfig.AdminConfig.Token, handleUsageRequest(mongoSession, sites)))
+		adminServeMux.HandleFunc("/v1/particles", requireAdminToken(tetryonConfig.AdminConfig.Token, handleParticlesRequest(mongoSession, sites)))
+		adminServeMux.HandleFunc(identitiesPath, requireAdminToken(tetryonConfig.AdminConfig.Token, handleIdentitiesRequest(mongoSession, sites)))
+		adminServeMux.HandleFunc("/v1/stats", requireAdminToken(tetryonConfig.AdminConfig.Token, handleStatsRequest(mongoSession, sites)))
+		adminServeMux.HandleFunc("/v1/uniques", requireAdminToken(tetryonConfig.AdminConfig.Token, handleUniquesRequest(mongoSession, sites)))
+		adminServeMux.HandleFunc("/v1/funnels", requireAdminToken(tetryonConfig.AdminConfig.Token, handleFunnelsRequest(mongoSession, sites)))
+		adminServeMux.HandleFunc("/v1/retention", requireAdminToken(tetryonConfig.AdminConfig.Token, handleRetentionRequest(mongoSession, sites)))
+		adminServeMux.HandleFunc("/v1/stream", requireAdminToken(tetryonConfig.AdminConfig.Token, handleStreamRequest(sites, stream)))
+		adminServeMux.Handle(dashboardPath, handleDashboardRequest())
+		adminServeMux.HandleFunc("/", http.NotFound)
+
+		go func() {
+			if err := http.ListenAndServe(
+				tetryonConfig.AdminConfig.Hostname+":"+tetryonConfig.AdminConfig.Port,
+				adminServeMux); err != nil {
+				log.Fatal(err)
+			}
+		}()
+	}
+
 	go func() {
-		logDatabaseStats(mongoSession)
+		logSitesDatabaseStats(mongoSession, sites)
 		for _ = range time.Tick(databaseLogIntervalSeconds * time.Second) {
-			logDatabaseStats(mongoSession)
+			logSitesDatabaseStats(mongoSession, sites)
 		}
 	}()
 
@@ -126,6 +230,52 @@ func main() {
 		logRequestsHandled(requestsHandled)
 		for _ = range time.Tick(requestsLogIntervalSeconds * time.Second) {
 			logRequestsHandled(requestsHandled)
+			logRequestsExpired(requestsExpired)
+			logBotCounts(bots)
+			logRateLimits(limiter)
+			logDomainRejections(sites)
+			logSignatureCounts(verifier)
+			logSchemaViolations(schemas)
+			logParamLimits(limits)
+			logActiveSessions(sessions)
+			logStreamCounts(stream)
+			logWebhookCounts(webhooks)
+		}
+	}()
+
+	go func() {
+		for _ = range time.Tick(rollupFlushIntervalSeconds * time.Second) {
+			flushSitesRollups(mongoSession, sites)
+		}
+	}()
+
+	go func() {
+		for _ = range time.Tick(uniquesFlushIntervalSeconds * time.Second) {
+			flushSitesUniques(mongoSession, sites)
+		}
+	}()
+
+	go func() {
+		for now := range time.Tick(requestExpirySeconds * time.Second) {
+			admitter.Sweep(now)
+			requestsExpired += expireActiveRequests(activeRequests, mutex, now)
+		}
+	}()
+
+	go func() {
+		for now := range time.Tick(sessionSweepIntervalSeconds * time.Second) {
+			sessions.Sweep(now)
+		}
+	}()
+
+	go func() {
+		for _ = range time.Tick(userAgentRulesCheckIntervalSeconds * time.Second) {
+			reloaded, err := uaParser.Reload()
+			if err != nil {
+				log.Println(err)
+			} else if reloaded {
+				log.Println("Reloaded user agent rules.")
+			}
 		}
 	}()
 
@@ -153,21 +303,37 @@ func loadMongoSession(mongoConfig MongoConfig) (*mgo.Session, error) {
 	return session, nil
 }
 
-func logDatabaseStats(session *mgo.Session) {
+// Sites may share a database, so each one is only logged once.
+func logSitesDatabaseStats(session *mgo.Session, sites *siteRouter) {
+	logged := make(map[string]bool)
+
+	for _, s := range sites.Sites() {
+		if !logged[s.Database] {
+			logDatabaseStats(session, s.Database)
+			logged[s.Database] = true
+		}
+	}
+}
+
+func logDatabaseStats(session *mgo.Session, database string) {
 	sessionCopy := session.Copy()
 	defer sessionCopy.Close()
 
-	db := sessionCopy.DB("tetryon")
+	db := sessionCopy.DB(database)
 
 	var dbStats DBStats
 	if err := db.Run(bson.D{{"dbStats", 1}, {"scale", 1}}, &dbStats); err != nil {
 		log.Println(err)
 	}
 
-	log.Printf("Database Size: %0.2f MiB , Collections: %0.2f MiB , Indexes: %0.2f MiB \n", dbStats.StorageSize/1048576, dbStats.DataSize/1048576, dbStats.IndexSize/1048576)
+	log.Printf("Database ( %s ) Size: %0.2f MiB , Collections: %0.2f MiB , Indexes: %0.2f MiB \n", database, dbStats.StorageSize/1048576, dbStats.DataSize/1048576, dbStats.IndexSize/1048576)
 }
 
 func logRequestsHandled(requests int64) {
 	log.Printf("Total requests: %d", requests)
 	// log.Printf("Total requests: %d Requests per second: %0.2f", requests, math.Floor(float64(requests/seconds)))
 }
+
+func logRequestsExpired(requests int64) {
+	log.Printf("Expired requests: %d", requests)
+}
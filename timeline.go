@@ -0,0 +1,123 @@
+package main
+
+import (
+	"gopkg.in/mgo.v2"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const identitiesPath = "/v1/identities/"
+
+// A particle as it appears on an identifier's timeline.
+type timelineEntry struct {
+	Id        string                 `json:"id"`
+	Timestamp int64                  `json:"timestamp"`
+	Event     string                 `json:"event"`
+	Domain    string                 `json:"domain"`
+	Path      string                 `json:"path"`
+	BeamId    string                 `json:"beam_id"`
+	SessionId string                 `json:"session_id,omitempty"`
+	Device    string                 `json:"device"`
+	Data      map[string]interface{} `json:"data"`
+}
+
+type timelinePage struct {
+	Identifier string                   `json:"identifier"`
+	Traits     map[string]identityTrait `json:"traits,omitempty"`
+	Entries    []timelineEntry          `json:"entries"`
+	NextCursor string                   `json:"next_cursor,omitempty"`
+}
+
+// Read one page of the particles of every beam with the identifier, in
+// order.
+func GetTimeline(session *mgo.Session, s *site, q *particleQuery) (*timelinePage, error) {
+	page, err := GetParticles(session, s, q)
+
+	if err != nil {
+		return nil, err
+	}
+
+	timeline := &timelinePage{
+		Identifier: q.Identifier,
+		Entries:    make([]timelineEntry, 0, len(page.Particles)),
+		NextCursor: page.NextCursor,
+	}
+
+	for _, p := range page.Particles {
+		timeline.Entries = append(timeline.Entries, timelineEntry{
+			Id:        p.Id.Hex(),
+			Timestamp: p.Timestamp,
+			Event:     p.Event,
+			Domain:    p.Domain,
+			Path:      p.Path,
+			BeamId:    p.BeamId,
+			SessionId: p.SessionId,
+			Device:    p.UserAgent.Device,
+			Data:      p.Data,
+		})
+	}
+
+	i, err := GetIdentity(q.Identifier, session, s)
+
+	if err == nil {
+		timeline.Traits = i.Traits
+	} else if err != mgo.ErrNotFound {
+		return nil, err
+	}
+
+	return timeline, nil
+}
+
+// GET /v1/identities/<identifier>/timeline?site=<id>
+// Takes the same filters and paging parameters as /v1/particles, other than
+// identifier and format.  The identifier is path-escaped.
+func handleIdentitiesRequest(session *mgo.Session, sites *siteRouter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			writeJsonError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+
+		segments := strings.Split(strings.TrimPrefix(r.URL.EscapedPath(), identitiesPath), "/")
+
+		if len(segments) != 2 || segments[1] != "timeline" {
+			writeJsonError(w, http.StatusNotFound, "not found")
+			return
+		}
+
+		identifier, err := url.PathUnescape(segments[0])
+
+		if err != nil || len(identifier) == 0 {
+			writeJsonError(w, http.StatusBadRequest, "invalid identifier")
+			return
+		}
+
+		s, status, err := adminSite(sites, r)
+
+		if err != nil {
+			writeJsonError(w, status, err.Error())
+			return
+		}
+
+		q, err := parseParticleQuery(r)
+
+		if err != nil {
+			writeJsonError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		q.Identifier = identifier
+
+		timeline, err := GetTimeline(session, s, q)
+
+		if err != nil {
+			log.Println(err)
+			writeJsonError(w, http.StatusInternalServerError, "could not read timeline")
+			return
+		}
+
+		writeJson(w, http.StatusOK, timeline)
+	}
+}
@@ -0,0 +1,369 @@
+package main
+
+import (
+	"errors"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	uniqueCollectionName = "uniques"
+)
+
+const uniquesFlushIntervalSeconds = 60
+
+// How many particles a rebuild counts between flushes, to bound its memory.
+const uniquesRebuildFlushParticles = 100000
+
+// Unique beams are counted per period for the whole site ( the "all"
+// dimension, with an empty value ) and per event, domain and path.
+const uniqueDimensionAll = "all"
+
+var uniqueDimensions = []string{"event", "domain", "path"}
+
+// A stored sketch.  Each node writes its own, so sketches are never updated
+// by more than one process; they are merged when read.
+type uniqueSketch struct {
+	Id        string `bson:"_id"`
+	Node      string `bson:"node"`
+	Period    string `bson:"period"`
+	Start     int64  `bson:"start"`
+	Dimension string `bson:"dimension"`
+	Value     string `bson:"value"`
+	Registers []byte `bson:"registers"`
+}
+
+type uniquesQuery struct {
+	Period    string
+	Dimension string
+	Value     string
+	From      int64
+	To        int64
+}
+
+type uniquesResponse struct {
+	Beams int64   `json:"beams"`
+	Error float64 `json:"error"`
+}
+
+// Sketches of the beams seen since the last flush.
+type uniqueCounter struct {
+	node     string
+	sketches map[rollupKey]*hyperLogLog
+	mutex    sync.Mutex
+}
+
+func newUniqueCounter(node string) *uniqueCounter {
+	return &uniqueCounter{
+		node:     node,
+		sketches: make(map[rollupKey]*hyperLogLog),
+	}
+}
+
+// The node name sketches are stored under: configured, or the hostname.
+func uniquesNode(uniquesConfig UniquesConfig) string {
+	if len(uniquesConfig.Node) > 0 {
+		return uniquesConfig.Node
+	}
+
+	if hostname, err := os.Hostname(); err == nil {
+		return hostname
+	}
+
+	return "tetryon"
+}
+
+func validUniqueDimension(dimension string) bool {
+	if dimension == uniqueDimensionAll {
+		return true
+	}
+
+	for _, d := range uniqueDimensions {
+		if d == dimension {
+			return true
+		}
+	}
+
+	return false
+}
+
+func setupUniquesCollection(session *mgo.Session, s *site) error {
+	sessionCopy := session.Copy()
+	defer sessionCopy.Close()
+
+	uniqueCollection := s.Collection(sessionCopy, uniqueCollectionName)
+
+	return uniqueCollection.EnsureIndexKey("period", "dimension", "value", "start")
+}
+
+func (c *uniqueCounter) Add(p *particle) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for _, period := range rollupPeriods {
+		start := rollupPeriodStart(period, p.Timestamp)
+
+		keys := []rollupKey{{period, start, uniqueDimensionAll, ""}}
+		for _, dimension := range uniqueDimensions {
+			keys = append(keys, rollupKey{period, start, dimension, rollupDimensionValue(dimension, p)})
+		}
+
+		for _, key := range keys {
+			sketch, ok := c.sketches[key]
+
+			if !ok {
+				sketch = newHyperLogLog()
+				c.sketches[key] = sketch
+			}
+
+			sketch.Add(p.BeamId)
+		}
+	}
+}
+
+// Merge the sketches into this node's stored ones.  Sketches that can't be
+// written are kept for the next flush.
+func (c *uniqueCounter) Flush(session *mgo.Session, s *site) error {
+	c.mutex.Lock()
+	sketches := c.sketches
+	c.sketches = make(map[rollupKey]*hyperLogLog)
+	c.mutex.Unlock()
+
+	if len(sketches) == 0 {
+		return nil
+	}
+
+	sessionCopy := session.Copy()
+	defer sessionCopy.Close()
+
+	uniqueCollection := s.Collection(sessionCopy, uniqueCollectionName)
+
+	var err error
+
+	for key, sketch := range sketches {
+		id := c.node + ":" + rollupId(key)
+
+		var stored uniqueSketch
+
+		err = uniqueCollection.FindId(id).One(&stored)
+
+		if err == nil {
+			var previous *hyperLogLog
+			if previous, err = loadHyperLogLog(stored.Registers); err == nil {
+				sketch.Merge(previous)
+			}
+		} else if err == mgo.ErrNotFound {
+			err = nil
+		}
+
+		if err == nil {
+			_, err = uniqueCollection.UpsertId(id, uniqueSketch{
+				Id:        id,
+				Node:      c.node,
+				Period:    key.Period,
+				Start:     key.Start,
+				Dimension: key.Dimension,
+				Value:     key.Value,
+				Registers: sketch.Bytes(),
+			})
+		}
+
+		if err != nil {
+			break
+		}
+
+		delete(sketches, key)
+	}
+
+	if len(sketches) > 0 {
+		c.mutex.Lock()
+		for key, sketch := range sketches {
+			if current, ok := c.sketches[key]; ok {
+				sketch.Merge(current)
+			}
+			c.sketches[key] = sketch
+		}
+		c.mutex.Unlock()
+	}
+
+	return err
+}
+
+func flushSitesUniques(session *mgo.Session, sites *siteRouter) {
+	for _, s := range sites.Sites() {
+		if err := s.uniques.Flush(session, s); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// Replace the sketches from the start of since's day onwards with sketches
+// counted from the particles collection, stored under node.  Every node's
+// sketches are removed, so nothing else should be writing to the site.
+func RebuildUniques(session *mgo.Session, s *site, since time.Time, node string) error {
+	sessionCopy := session.Copy()
+	defer sessionCopy.Close()
+
+	particleCollection := s.Collection(sessionCopy, particleCollectionName)
+	uniqueCollection := s.Collection(sessionCopy, uniqueCollectionName)
+
+	from := rollupPeriodStart("day", since.Unix())
+
+	if _, err := uniqueCollection.RemoveAll(bson.M{"start": bson.M{"$gte": from}}); err != nil {
+		return err
+	}
+
+	counter := newUniqueCounter(node)
+	counted := 0
+
+	iter := particleCollection.Find(bson.M{"timestamp": bson.M{"$gte": from}}).
+		Select(bson.M{"timestamp": 1, "beam_id": 1, "event": 1, "domain": 1, "path": 1}).
+		Iter()
+
+	var p particle
+
+	for iter.Next(&p) {
+		counter.Add(&p)
+		counted++
+
+		if counted%uniquesRebuildFlushParticles == 0 {
+			if err := counter.Flush(sessionCopy, s); err != nil {
+				iter.Close()
+				return err
+			}
+		}
+	}
+
+	if err := iter.Close(); err != nil {
+		return err
+	}
+
+	return counter.Flush(sessionCopy, s)
+}
+
+// Read the stored sketches for a period and dimension in [from, to), merged
+// across nodes.  Sketches are keyed by start and value; all values are read
+// if value is nil.
+func GetUniqueSketches(session *mgo.Session, s *site, period string, dimension string, value *string, from int64, to int64) (map[rollupKey]*hyperLogLog, error) {
+	sessionCopy := session.Copy()
+	defer sessionCopy.Close()
+
+	uniqueCollection := s.Collection(sessionCopy, uniqueCollectionName)
+
+	query := bson.M{
+		"period":    period,
+		"dimension": dimension,
+		"start":     bson.M{"$gte": rollupPeriodStart(period, from), "$lt": to},
+	}
+
+	if value != nil {
+		query["value"] = *value
+	}
+
+	merged := make(map[rollupKey]*hyperLogLog)
+
+	var stored uniqueSketch
+
+	iter := uniqueCollection.Find(query).Iter()
+
+	for iter.Next(&stored) {
+		sketch, err := loadHyperLogLog(stored.Registers)
+
+		if err != nil {
+			iter.Close()
+			return nil, err
+		}
+
+		key := rollupKey{stored.Period, stored.Start, stored.Dimension, stored.Value}
+
+		if current, ok := merged[key]; ok {
+			current.Merge(sketch)
+		} else {
+			merged[key] = sketch
+		}
+	}
+
+	if err := iter.Close(); err != nil {
+		return nil, err
+	}
+
+	return merged, nil
+}
+
+// GET /v1/uniques?site=<id>&period=<hour|day>&dimension=<all|event|domain|path>&value=
+// Estimates the unique beams over the whole from / to range ( the last day by
+// default ), for a dimension value or the whole site.
+func handleUniquesRequest(session *mgo.Session, sites *siteRouter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			writeJsonError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+
+		s, status, err := adminSite(sites, r)
+
+		if err != nil {
+			writeJsonError(w, status, err.Error())
+			return
+		}
+
+		q, err := parseUniquesQuery(r)
+
+		if err != nil {
+			writeJsonError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		sketches, err := GetUniqueSketches(session, s, q.Period, q.Dimension, &q.Value, q.From, q.To)
+
+		if err != nil {
+			log.Println(err)
+			writeJsonError(w, http.StatusInternalServerError, "could not read uniques")
+			return
+		}
+
+		total := newHyperLogLog()
+		for _, sketch := range sketches {
+			total.Merge(sketch)
+		}
+
+		writeJson(w, http.StatusOK, uniquesResponse{Beams: total.Estimate(), Error: hllStandardError})
+	}
+}
+
+func parseUniquesQuery(r *http.Request) (*uniquesQuery, error) {
+	var err error
+
+	q := &uniquesQuery{
+		Period:    r.FormValue("period"),
+		Dimension: r.FormValue("dimension"),
+		Value:     r.FormValue("value"),
+	}
+
+	if len(q.Period) == 0 {
+		q.Period = "day"
+	}
+
+	if q.Period != "hour" && q.Period != "day" {
+		return nil, errors.New("invalid period: " + q.Period)
+	}
+
+	if len(q.Dimension) == 0 {
+		q.Dimension = uniqueDimensionAll
+	}
+
+	if !validUniqueDimension(q.Dimension) {
+		return nil, errors.New("invalid dimension: " + q.Dimension)
+	}
+
+	if q.From, q.To, err = parseQueryRange(r); err != nil {
+		return nil, err
+	}
+
+	return q, nil
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"hash/fnv"
+	"sync"
+	"time"
+)
+
+const (
+	usageCollectionName = "usage"
+)
+
+const (
+	usagePeriodDay   = "day"
+	usagePeriodMonth = "month"
+)
+
+// Results of checking a site's usage against its quota.
+const (
+	quotaAllow  = "allow"
+	quotaSample = "sample"
+	quotaReject = "reject"
+)
+
+// Particle counts are kept in one document per site and period, i.e.
+// "shop:day:2015-01-10" and "shop:month:2015-01".
+type usage struct {
+	Id        string `bson:"_id" json:"-"`
+	Site      string `bson:"site" json:"site"`
+	Period    string `bson:"period" json:"period"`
+	Start     string `bson:"start" json:"start"`
+	Particles int64  `bson:"particles" json:"particles"`
+}
+
+// In-memory counts for the current day and month, so quotas can be checked
+// without a database round trip on every request.
+type siteUsage struct {
+	day        string
+	dayCount   int64
+	month      string
+	monthCount int64
+	mutex      sync.Mutex
+}
+
+func usagePeriodStart(period string, t time.Time) string {
+	if period == usagePeriodMonth {
+		return t.UTC().Format("2006-01")
+	}
+
+	return t.UTC().Format("2006-01-02")
+}
+
+func usageId(siteId string, period string, start string) string {
+	return siteId + ":" + period + ":" + start
+}
+
+func setupUsageCollection(session *mgo.Session, s *site) error {
+	sessionCopy := session.Copy()
+	defer sessionCopy.Close()
+
+	usageCollection := s.Collection(sessionCopy, usageCollectionName)
+
+	return usageCollection.EnsureIndexKey("site", "period", "start")
+}
+
+// Load the counts for the current day and month into memory.
+func loadSiteUsage(session *mgo.Session, s *site) error {
+	sessionCopy := session.Copy()
+	defer sessionCopy.Close()
+
+	usageCollection := s.Collection(sessionCopy, usageCollectionName)
+
+	now := time.Now()
+
+	u := &siteUsage{
+		day:   usagePeriodStart(usagePeriodDay, now),
+		month: usagePeriodStart(usagePeriodMonth, now),
+	}
+
+	var current usage
+
+	err := usageCollection.FindId(usageId(s.Id, usagePeriodDay, u.day)).One(&current)
+	if err != nil && err != mgo.ErrNotFound {
+		return err
+	}
+	u.dayCount = current.Particles
+
+	current = usage{}
+
+	err = usageCollection.FindId(usageId(s.Id, usagePeriodMonth, u.month)).One(&current)
+	if err != nil && err != mgo.ErrNotFound {
+		return err
+	}
+	u.monthCount = current.Particles
+
+	s.usage = u
+
+	return nil
+}
+
+// Roll the counters over if the day or month has changed.  Must hold the mutex.
+func (u *siteUsage) rollover(now time.Time) {
+	if day := usagePeriodStart(usagePeriodDay, now); day != u.day {
+		u.day = day
+		u.dayCount = 0
+	}
+
+	if month := usagePeriodStart(usagePeriodMonth, now); month != u.month {
+		u.month = month
+		u.monthCount = 0
+	}
+}
+
+func (u *siteUsage) Add(now time.Time) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	u.rollover(now)
+	u.dayCount++
+	u.monthCount++
+}
+
+// Check the current counts against a quota.  Limits of 0 are ignored.
+// Sampling is decided by hashing sampleKey, so every part of a split request
+// gets the same result.
+func (u *siteUsage) Check(quota QuotaConfig, sampleKey string) string {
+	u.mutex.Lock()
+	u.rollover(time.Now())
+	dayCount, monthCount := u.dayCount, u.monthCount
+	u.mutex.Unlock()
+
+	if (quota.DailyHard > 0 && dayCount >= quota.DailyHard) ||
+		(quota.MonthlyHard > 0 && monthCount >= quota.MonthlyHard) {
+		return quotaReject
+	}
+
+	if (quota.DailySoft > 0 && dayCount >= quota.DailySoft) ||
+		(quota.MonthlySoft > 0 && monthCount >= quota.MonthlySoft) {
+		if sampleFraction(sampleKey) < quota.SampleRate {
+			return quotaAllow
+		}
+		return quotaSample
+	}
+
+	return quotaAllow
+}
+
+// Map a key onto [0, 1).
+func sampleFraction(key string) float64 {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+
+	return float64(h.Sum32()) / (1 << 32)
+}
+
+// Count a saved particle against its site.
+func (s *site) RecordUsage(session *mgo.Session, t time.Time) error {
+	s.usage.Add(t)
+
+	sessionCopy := session.Copy()
+	defer sessionCopy.Close()
+
+	usageCollection := s.Collection(sessionCopy, usageCollectionName)
+
+	for _, period := range []string{usagePeriodDay, usagePeriodMonth} {
+		start := usagePeriodStart(period, t)
+
+		_, err := usageCollection.UpsertId(usageId(s.Id, period, start), bson.M{
+			"$set": bson.M{"site": s.Id, "period": period, "start": start},
+			"$inc": bson.M{"particles": 1},
+		})
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func GetSiteUsage(session *mgo.Session, s *site, period string) ([]usage, error) {
+	sessionCopy := session.Copy()
+	defer sessionCopy.Close()
+
+	usageCollection := s.Collection(sessionCopy, usageCollectionName)
+
+	query := bson.M{"site": s.Id}
+	if len(period) > 0 {
+		query["period"] = period
+	}
+
+	usages := []usage{}
+	err := usageCollection.Find(query).Sort("period", "start").All(&usages)
+
+	return usages, err
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultUserAgentCacheSize = 10000
+
+const userAgentRulesCheckIntervalSeconds = 300
+
+const (
+	userAgentUnknown   = "unknown"
+	deviceClassDesktop = "desktop"
+)
+
+type userAgent struct {
+	Raw     string `bson:"raw" json:"raw"`
+	Browser string `bson:"browser" json:"browser"`
+	Version string `bson:"version" json:"version"`
+	OS      string `bson:"os" json:"os"`
+	Device  string `bson:"device" json:"device"`
+	Bot     bool   `bson:"bot" json:"bot"`
+	botRule string
+}
+
+type userAgentRule struct {
+	Name    string `json:"name"`
+	Pattern string `json:"pattern"`
+	regexp  *regexp.Regexp
+}
+
+// Rules are evaluated in order and the first match wins.  If a pattern has a
+// capture group, the first group is used as the version.
+type userAgentRules struct {
+	Browsers []userAgentRule `json:"browsers"`
+	OS       []userAgentRule `json:"os"`
+	Devices  []userAgentRule `json:"devices"`
+	Bots     []userAgentRule `json:"bots"`
+}
+
+type userAgentParser struct {
+	rulesPath    string
+	rulesModTime time.Time
+	rules        *userAgentRules
+	cacheSize    int
+	cache        map[string]userAgent
+	mutex        sync.RWMutex
+}
+
+func loadUserAgentParser(userAgentConfig UserAgentConfig) (*userAgentParser, error) {
+	parser := &userAgentParser{
+		rulesPath: userAgentConfig.Rules,
+		cacheSize: userAgentConfig.CacheSize,
+		cache:     make(map[string]userAgent),
+	}
+
+	if parser.cacheSize <= 0 {
+		parser.cacheSize = defaultUserAgentCacheSize
+	}
+
+	if len(parser.rulesPath) == 0 {
+		return parser, nil
+	}
+
+	if _, err := parser.Reload(); err != nil {
+		return nil, err
+	}
+
+	return parser, nil
+}
+
+func loadUserAgentRules(rulesPath string) (*userAgentRules, error) {
+	rulesData, err := ioutil.ReadFile(rulesPath)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var rules userAgentRules
+	if err = json.Unmarshal(rulesData, &rules); err != nil {
+		return nil, fmt.Errorf("User agent rules error: %s", err)
+	}
+
+	for _, ruleSet := range [][]userAgentRule{rules.Browsers, rules.OS, rules.Devices, rules.Bots} {
+		for i := range ruleSet {
+			if ruleSet[i].regexp, err = regexp.Compile(ruleSet[i].Pattern); err != nil {
+				return nil, fmt.Errorf("User agent rules error: %s: %s", ruleSet[i].Name, err)
+			}
+		}
+	}
+
+	return &rules, nil
+}
+
+// Reload the rules file if it has changed on disk since it was last loaded.
+// Returns true if new rules were loaded.
+func (u *userAgentParser) Reload() (bool, error) {
+	if len(u.rulesPath) == 0 {
+		return false, nil
+	}
+
+	rulesFileInfo, err := os.Stat(u.rulesPath)
+
+	if err != nil {
+		return false, err
+	}
+
+	u.mutex.RLock()
+	unchanged := u.rules != nil && rulesFileInfo.ModTime().Equal(u.rulesModTime)
+	u.mutex.RUnlock()
+
+	if unchanged {
+		return false, nil
+	}
+
+	rules, err := loadUserAgentRules(u.rulesPath)
+
+	if err != nil {
+		return false, err
+	}
+
+	u.mutex.Lock()
+	u.rules = rules
+	u.rulesModTime = rulesFileInfo.ModTime()
+	u.cache = make(map[string]userAgent)
+	u.mutex.Unlock()
+
+	return true, nil
+}
+
+func (u *userAgentParser) Parse(raw string) userAgent {
+	u.mutex.RLock()
+	ua, ok := u.cache[raw]
+	rules := u.rules
+	u.mutex.RUnlock()
+
+	if ok {
+		return ua
+	}
+
+	ua = userAgent{
+		Raw:     raw,
+		Browser: userAgentUnknown,
+		OS:      userAgentUnknown,
+		Device:  userAgentUnknown,
+	}
+
+	if rules == nil || len(raw) == 0 {
+		return ua
+	}
+
+	ua.Browser, ua.Version = matchUserAgentRules(rules.Browsers, raw)
+	ua.OS, _ = matchUserAgentRules(rules.OS, raw)
+	ua.Device, _ = matchUserAgentRules(rules.Devices, raw)
+
+	if ua.Device == userAgentUnknown {
+		ua.Device = deviceClassDesktop
+	}
+
+	if bot, _ := matchUserAgentRules(rules.Bots, raw); bot != userAgentUnknown {
+		ua.Bot = true
+		ua.botRule = bot
+	}
+
+	u.mutex.Lock()
+	// Keep memory bounded; a full reset is cheap relative to parsing.
+	if len(u.cache) >= u.cacheSize {
+		u.cache = make(map[string]userAgent)
+	}
+	u.cache[raw] = ua
+	u.mutex.Unlock()
+
+	return ua
+}
+
+func matchUserAgentRules(rules []userAgentRule, raw string) (string, string) {
+	for _, rule := range rules {
+		matches := rule.regexp.FindStringSubmatch(raw)
+
+		if matches == nil {
+			continue
+		}
+
+		if len(matches) > 1 {
+			return rule.Name, strings.Replace(matches[1], "_", ".", -1)
+		}
+
+		return rule.Name, ""
+	}
+
+	return userAgentUnknown, ""
+}
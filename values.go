@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Data values are strings unless typed, either by the schema for their event
+// or by a suffix on their key, i.e. "quantity:int" is stored as "quantity".
+const typeSuffixSeparator = ":"
+
+// Types a data value can be stored as.
+const (
+	valueTypeString = "string"
+	valueTypeInt    = "int"
+	valueTypeFloat  = "float"
+	valueTypeBool   = "bool"
+	valueTypeTime   = "time"
+)
+
+// Types of nested values.  These can't be used as key suffixes.
+const (
+	valueTypeObject = "object"
+	valueTypeArray  = "array"
+)
+
+// Split a key into its name and type suffix.  Keys without a known suffix
+// are returned as they are, with no type.
+func splitTypedKey(key string) (string, string) {
+	i := strings.LastIndex(key, typeSuffixSeparator)
+
+	if i <= 0 {
+		return key, ""
+	}
+
+	switch valueType := key[i+1:]; valueType {
+	case valueTypeString, valueTypeInt, valueTypeFloat, valueTypeBool, valueTypeTime:
+		return key[:i], valueType
+	}
+
+	return key, ""
+}
+
+// Type every parameter by its key suffix, keyed by name.  Values that don't
+// parse are kept as strings.  When keys share a name ( i.e. "a" and "a:int" )
+// the first in sorted order - the one without a suffix, if it was sent - is
+// stored under the name, and the others are kept as strings under their full
+// key.  The result never depends on map order.
+func typeDataValues(params map[string]string) map[string]interface{} {
+	keys := make([]string, 0, len(params))
+	for key := range params {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	data := make(map[string]interface{})
+
+	for _, key := range keys {
+		value := params[key]
+		name, valueType := splitTypedKey(key)
+
+		if untypedDataKey(name) {
+			valueType = ""
+		}
+
+		if _, ok := data[name]; ok {
+			data[key] = value
+			continue
+		}
+
+		if typed, err := parseTypedValue(valueType, value); err == nil {
+			data[name] = typed
+		} else {
+			data[name] = value
+		}
+	}
+
+	return data
+}
+
+// Keys that are always stored as strings, whatever their suffix or schema
+// says, as they are joined into the campaign.
+func untypedDataKey(name string) bool {
+	for _, key := range sessionCampaignKeys {
+		if name == key {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Parse a string value as the given type.  Times are either RFC 3339 or a
+// unix timestamp in milliseconds ( like the one that ends a beam ID ).
+func parseTypedValue(valueType string, value string) (interface{}, error) {
+	switch valueType {
+	case valueTypeInt:
+		return strconv.ParseInt(value, 10, 64)
+	case valueTypeFloat:
+		return strconv.ParseFloat(value, 64)
+	case valueTypeBool:
+		return strconv.ParseBool(value)
+	case valueTypeTime:
+		if millis, err := strconv.ParseInt(value, 10, 64); err == nil {
+			return time.Unix(millis/1000, (millis%1000)*int64(time.Millisecond)).UTC(), nil
+		}
+		return time.Parse(time.RFC3339, value)
+	case valueTypeString, "":
+		return value, nil
+	}
+
+	return nil, fmt.Errorf("Unknown value type: %s", valueType)
+}
+
+// Whether an already typed value is of the given type.
+func typedValueIs(valueType string, value interface{}) bool {
+	switch value.(type) {
+	case string:
+		return valueType == valueTypeString
+	case int64:
+		return valueType == valueTypeInt
+	case float64:
+		return valueType == valueTypeFloat
+	case bool:
+		return valueType == valueTypeBool
+	case time.Time:
+		return valueType == valueTypeTime
+	case map[string]interface{}:
+		return valueType == valueTypeObject
+	case []interface{}:
+		return valueType == valueTypeArray
+	}
+
+	return false
+}
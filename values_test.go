@@ -0,0 +1,48 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestTypeDataValues(t *testing.T) {
+	tests := []struct {
+		params map[string]string
+		want   map[string]interface{}
+	}{
+		{
+			map[string]string{"a": "1", "b:int": "2", "c:float": "1.5", "d:bool": "true"},
+			map[string]interface{}{"a": "1", "b": int64(2), "c": 1.5, "d": true},
+		},
+		{
+			map[string]string{"a:int": "x"},
+			map[string]interface{}{"a": "x"},
+		},
+		{
+			map[string]string{"a": "1", "a:int": "2"},
+			map[string]interface{}{"a": "1", "a:int": "2"},
+		},
+		{
+			map[string]string{"a:int": "2", "a:float": "1.5"},
+			map[string]interface{}{"a": 1.5, "a:int": "2"},
+		},
+		{
+			map[string]string{"utm_source:int": "5", "utm_medium": "cpc"},
+			map[string]interface{}{"utm_source": "5", "utm_medium": "cpc"},
+		},
+		{
+			map[string]string{"a:int": "2", "a:int:int": "3"},
+			map[string]interface{}{"a": int64(2), "a:int": int64(3)},
+		},
+	}
+
+	for _, test := range tests {
+		// Map order varies between runs, so check each case a few times.
+		for i := 0; i < 10; i++ {
+			if got := typeDataValues(test.params); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("typeDataValues(%v) = %v, want %v", test.params, got, test.want)
+				break
+			}
+		}
+	}
+}
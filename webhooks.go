@@ -0,0 +1,434 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	webhookDeadLetterCollectionName = "webhook_dead_letters"
+)
+
+const (
+	defaultWebhookBatchSize    = 100
+	defaultWebhookBatchSeconds = 5
+	defaultWebhookMaxAttempts  = 5
+	defaultWebhookQueueSize    = 10000
+)
+
+// Retries wait 1s, 2s, 4s ... up to 5 minutes between attempts.
+const (
+	webhookInitialBackoff = time.Second
+	webhookMaxBackoff     = 5 * time.Minute
+)
+
+const webhookTimeoutSeconds = 10
+
+// How many batches each webhook delivers at once.
+const webhookWorkers = 4
+
+const (
+	webhookNameHeader      = "X-Tetryon-Webhook"
+	webhookTimestampHeader = "X-Tetryon-Timestamp"
+)
+
+// The body of a webhook request: a batch of particles from one site.
+type webhookPayload struct {
+	Webhook   string      `json:"webhook"`
+	Site      string      `json:"site"`
+	Particles []*particle `json:"particles"`
+}
+
+// A batch that couldn't be delivered, kept for inspection or replay.
+type webhookDeadLetter struct {
+	Id        bson.ObjectId `bson:"_id"`
+	Webhook   string        `bson:"webhook"`
+	Created   int64         `bson:"created"`
+	Attempts  int           `bson:"attempts"`
+	Error     string        `bson:"error"`
+	Particles []*particle   `bson:"particles"`
+}
+
+type webhookDelivery struct {
+	site     *site
+	particle *particle
+}
+
+// A batch waiting for its next attempt, or to be dead lettered with err.
+type webhookBatch struct {
+	site      *site
+	particles []*particle
+	attempts  int
+	err       error
+}
+
+var errWebhookQueueFull = errors.New("queue full")
+
+// A failed delivery, and whether it is worth trying again.
+type webhookError struct {
+	err       error
+	retryable bool
+}
+
+func (e *webhookError) Error() string {
+	return e.err.Error()
+}
+
+// Forwards the particles with its events to one URL.  Particles are queued
+// without blocking the pipeline, batched per site by one goroutine and
+// delivered by webhookWorkers others.  A failed batch is retried on a timer,
+// so it never holds up the rest.  Particles that find the queue full ( up to
+// queue_size of them per batch_wait ), and batches that find the workers'
+// queue full, are dead lettered by a goroutine of their own.  Anything beyond
+// that is dropped.
+type webhookSink struct {
+	config      WebhookConfig
+	events      map[string]bool
+	client      *http.Client
+	queue       chan webhookDelivery
+	deliveries  chan *webhookBatch
+	deadLetters chan *webhookBatch
+	overflow    map[*site][]*particle
+	overflowed  int
+	backoff     time.Duration
+	deadLetter  func(s *site, attempts int, err error, particles []*particle)
+	dropped     int64
+	delivered   int64
+	failed      int64
+	mutex       sync.Mutex
+}
+
+type webhookDispatcher struct {
+	sinks []*webhookSink
+}
+
+func newWebhookSink(webhookConfig WebhookConfig) *webhookSink {
+	events := make(map[string]bool)
+	for _, event := range webhookConfig.Events {
+		events[event] = true
+	}
+
+	// Room for a full queue's worth of batches.
+	batches := webhookConfig.QueueSize/webhookConfig.BatchSize + 1
+
+	return &webhookSink{
+		config:      webhookConfig,
+		events:      events,
+		client:      &http.Client{Timeout: webhookTimeoutSeconds * time.Second},
+		queue:       make(chan webhookDelivery, webhookConfig.QueueSize),
+		deliveries:  make(chan *webhookBatch, batches),
+		deadLetters: make(chan *webhookBatch, 2*batches),
+		overflow:    make(map[*site][]*particle),
+		backoff:     webhookInitialBackoff,
+	}
+}
+
+func loadWebhookDispatcher(webhookConfigs []WebhookConfig) *webhookDispatcher {
+	d := &webhookDispatcher{}
+
+	for _, webhookConfig := range webhookConfigs {
+		d.sinks = append(d.sinks, newWebhookSink(webhookConfig))
+	}
+
+	return d
+}
+
+func setupWebhookDeadLettersCollection(session *mgo.Session, s *site) error {
+	sessionCopy := session.Copy()
+	defer sessionCopy.Close()
+
+	deadLetterCollection := s.Collection(sessionCopy, webhookDeadLetterCollectionName)
+
+	return deadLetterCollection.EnsureIndexKey("webhook", "created")
+}
+
+// Start delivering for every sink.
+func (d *webhookDispatcher) Start(session *mgo.Session) {
+	for _, k := range d.sinks {
+		k.Start(session)
+	}
+}
+
+func (d *webhookDispatcher) Publish(s *site, p *particle) {
+	for _, k := range d.sinks {
+		k.Publish(s, p)
+	}
+}
+
+func (k *webhookSink) Publish(s *site, p *particle) {
+	if !k.events[p.Event] {
+		return
+	}
+
+	select {
+	case k.queue <- webhookDelivery{s, p}:
+	default:
+		k.mutex.Lock()
+		if k.overflowed < k.config.QueueSize {
+			k.overflow[s] = append(k.overflow[s], p)
+			k.overflowed++
+		} else {
+			k.dropped++
+		}
+		k.mutex.Unlock()
+	}
+}
+
+// Start the batching goroutine, the workers and the dead letter writer.
+// Dead letters are saved to the site's collection unless deadLetter is
+// already set.
+func (k *webhookSink) Start(session *mgo.Session) {
+	if k.deadLetter == nil {
+		k.deadLetter = func(s *site, attempts int, err error, particles []*particle) {
+			if saveErr := saveWebhookDeadLetter(session, s, k.config.Name, attempts, err, particles); saveErr != nil {
+				log.Println(saveErr)
+			}
+		}
+	}
+
+	for i := 0; i < webhookWorkers; i++ {
+		go k.work()
+	}
+
+	go k.writeDeadLetters()
+	go k.Run()
+}
+
+// Batch queued particles per site, sending a batch once it is full or has
+// waited batch_wait seconds.
+func (k *webhookSink) Run() {
+	batches := make(map[*site][]*particle)
+	ticker := time.NewTicker(time.Duration(k.config.BatchSeconds) * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case delivery := <-k.queue:
+			batch := append(batches[delivery.site], delivery.particle)
+
+			if len(batch) < k.config.BatchSize {
+				batches[delivery.site] = batch
+				continue
+			}
+
+			delete(batches, delivery.site)
+			k.dispatch(&webhookBatch{site: delivery.site, particles: batch})
+		case <-ticker.C:
+			for s, batch := range batches {
+				delete(batches, s)
+				k.dispatch(&webhookBatch{site: s, particles: batch})
+			}
+
+			k.flushOverflow()
+		}
+	}
+}
+
+// Hand a batch to the workers, or dead letter it if they are that far behind.
+func (k *webhookSink) dispatch(batch *webhookBatch) {
+	select {
+	case k.deliveries <- batch:
+	default:
+		k.fail(batch, errWebhookQueueFull)
+	}
+}
+
+// Dead letter the particles that found the queue full, in batches.
+func (k *webhookSink) flushOverflow() {
+	k.mutex.Lock()
+	overflow, overflowed := k.overflow, k.overflowed
+	k.overflow = make(map[*site][]*particle)
+	k.overflowed = 0
+	k.mutex.Unlock()
+
+	if overflowed == 0 {
+		return
+	}
+
+	log.Printf("Webhook %s queue full, dead lettering %d particles", k.config.Name, overflowed)
+
+	for s, particles := range overflow {
+		for len(particles) > 0 {
+			size := k.config.BatchSize
+			if size > len(particles) {
+				size = len(particles)
+			}
+
+			k.queueDeadLetter(&webhookBatch{site: s, particles: particles[:size]}, errWebhookQueueFull)
+			particles = particles[size:]
+		}
+	}
+}
+
+func (k *webhookSink) work() {
+	for batch := range k.deliveries {
+		k.attempt(batch)
+	}
+}
+
+// Make one attempt at a batch.  Retryable failures are tried again after an
+// exponential backoff; batches that still fail, or are refused outright, are
+// dead lettered.
+func (k *webhookSink) attempt(batch *webhookBatch) {
+	batch.attempts++
+
+	err := k.deliver(batch.site.Id, batch.particles)
+
+	if err == nil {
+		k.mutex.Lock()
+		k.delivered += int64(len(batch.particles))
+		k.mutex.Unlock()
+		return
+	}
+
+	if e, ok := err.(*webhookError); ok && e.retryable && batch.attempts < k.config.MaxAttempts {
+		time.AfterFunc(k.retryDelay(batch.attempts), func() {
+			k.dispatch(batch)
+		})
+		return
+	}
+
+	k.fail(batch, err)
+}
+
+// The wait before the attempt after the given number: backoff, doubled for
+// every attempt after the first, up to webhookMaxBackoff.
+func (k *webhookSink) retryDelay(attempts int) time.Duration {
+	delay := k.backoff
+
+	for i := 1; i < attempts && delay < webhookMaxBackoff; i++ {
+		delay *= 2
+	}
+
+	if delay > webhookMaxBackoff {
+		delay = webhookMaxBackoff
+	}
+
+	return delay
+}
+
+func (k *webhookSink) fail(batch *webhookBatch, err error) {
+	log.Printf("Webhook %s failed after %d attempts: %s", k.config.Name, batch.attempts, err)
+
+	k.queueDeadLetter(batch, err)
+}
+
+// Hand a batch to the dead letter writer, counting its particles as failed.
+// If the writer is that far behind they are dropped instead.
+func (k *webhookSink) queueDeadLetter(batch *webhookBatch, err error) {
+	batch.err = err
+
+	select {
+	case k.deadLetters <- batch:
+		k.mutex.Lock()
+		k.failed += int64(len(batch.particles))
+		k.mutex.Unlock()
+	default:
+		k.mutex.Lock()
+		k.dropped += int64(len(batch.particles))
+		k.mutex.Unlock()
+	}
+}
+
+func (k *webhookSink) writeDeadLetters() {
+	for batch := range k.deadLetters {
+		k.deadLetter(batch.site, batch.attempts, batch.err, batch.particles)
+	}
+}
+
+// POST one batch.  The body is signed, with its timestamp, when the sink has
+// a secret: the signature header holds the hex HMAC-SHA256 of
+// "<timestamp>.<body>".
+func (k *webhookSink) deliver(siteId string, particles []*particle) error {
+	body, err := json.Marshal(webhookPayload{Webhook: k.config.Name, Site: siteId, Particles: particles})
+
+	if err != nil {
+		return &webhookError{err, false}
+	}
+
+	req, err := http.NewRequest("POST", k.config.Url, bytes.NewReader(body))
+
+	if err != nil {
+		return &webhookError{err, false}
+	}
+
+	for name, value := range k.config.Headers {
+		req.Header.Set(name, value)
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(webhookNameHeader, k.config.Name)
+	req.Header.Set(webhookTimestampHeader, timestamp)
+
+	if len(k.config.Secret) > 0 {
+		req.Header.Set(signatureHeader, webhookSignature(k.config.Secret, timestamp, body))
+	}
+
+	resp, err := k.client.Do(req)
+
+	if err != nil {
+		return &webhookError{err, true}
+	}
+
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+
+	// Other client errors won't succeed on a retry.
+	retryable := resp.StatusCode >= 500 ||
+		resp.StatusCode == http.StatusRequestTimeout ||
+		resp.StatusCode == http.StatusTooManyRequests
+
+	return &webhookError{fmt.Errorf("status %d", resp.StatusCode), retryable}
+}
+
+func webhookSignature(secret string, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func saveWebhookDeadLetter(session *mgo.Session, s *site, webhook string, attempts int, deliveryErr error, particles []*particle) error {
+	sessionCopy := session.Copy()
+	defer sessionCopy.Close()
+
+	deadLetterCollection := s.Collection(sessionCopy, webhookDeadLetterCollectionName)
+
+	return deadLetterCollection.Insert(webhookDeadLetter{
+		Id:        bson.NewObjectId(),
+		Webhook:   webhook,
+		Created:   time.Now().UTC().Unix(),
+		Attempts:  attempts,
+		Error:     deliveryErr.Error(),
+		Particles: particles,
+	})
+}
+
+func logWebhookCounts(d *webhookDispatcher) {
+	for _, k := range d.sinks {
+		k.mutex.Lock()
+		log.Printf("Webhook particles ( %s ): %d delivered, %d failed, %d dropped", k.config.Name, k.delivered, k.failed, k.dropped)
+		k.mutex.Unlock()
+	}
+}
@@ -0,0 +1,372 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A webhook receiver answering with statuses in turn, then with the last
+// one.
+type webhookReceiver struct {
+	server   *httptest.Server
+	statuses []int
+	requests []*http.Request
+	bodies   [][]byte
+	mutex    sync.Mutex
+}
+
+func newWebhookReceiver(statuses ...int) *webhookReceiver {
+	receiver := &webhookReceiver{statuses: statuses}
+
+	receiver.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+
+		receiver.mutex.Lock()
+		status := receiver.statuses[0]
+		if len(receiver.statuses) > 1 {
+			receiver.statuses = receiver.statuses[1:]
+		}
+		receiver.requests = append(receiver.requests, r)
+		receiver.bodies = append(receiver.bodies, body)
+		receiver.mutex.Unlock()
+
+		w.WriteHeader(status)
+	}))
+
+	return receiver
+}
+
+func (receiver *webhookReceiver) Requests() int {
+	receiver.mutex.Lock()
+	defer receiver.mutex.Unlock()
+
+	return len(receiver.requests)
+}
+
+type webhookDeadLetterCall struct {
+	attempts  int
+	err       error
+	particles []*particle
+}
+
+// A sink for the receiver, with a short backoff, that sends its dead letters
+// to the returned channel.
+func newTestWebhookSink(receiver *webhookReceiver, maxAttempts int) (*webhookSink, chan webhookDeadLetterCall) {
+	k := newWebhookSink(WebhookConfig{
+		Name:         "crm",
+		Url:          receiver.server.URL,
+		Events:       []string{"purchase"},
+		Secret:       "secret",
+		BatchSize:    2,
+		BatchSeconds: 60,
+		MaxAttempts:  maxAttempts,
+		QueueSize:    100,
+	})
+
+	deadLetters := make(chan webhookDeadLetterCall, 10)
+
+	k.backoff = time.Millisecond
+	k.deadLetter = func(s *site, attempts int, err error, particles []*particle) {
+		deadLetters <- webhookDeadLetterCall{attempts, err, particles}
+	}
+
+	return k, deadLetters
+}
+
+func waitForWebhook(t *testing.T, condition func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func (k *webhookSink) testCounts() (int64, int64) {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+
+	return k.delivered, k.failed
+}
+
+func TestWebhookBatchingAndSignature(t *testing.T) {
+	receiver := newWebhookReceiver(http.StatusOK)
+	defer receiver.server.Close()
+
+	k, _ := newTestWebhookSink(receiver, 1)
+	k.Start(nil)
+
+	s := &site{Id: "shop"}
+
+	k.Publish(s, &particle{Event: "purchase", BeamId: "a"})
+	k.Publish(s, &particle{Event: "visit", BeamId: "b"})
+	k.Publish(s, &particle{Event: "purchase", BeamId: "c"})
+
+	waitForWebhook(t, func() bool { return receiver.Requests() == 1 })
+
+	receiver.mutex.Lock()
+	r, body := receiver.requests[0], receiver.bodies[0]
+	receiver.mutex.Unlock()
+
+	var payload webhookPayload
+
+	if err := json.Unmarshal(body, &payload); err != nil {
+		t.Fatal(err)
+	}
+
+	if payload.Webhook != "crm" || payload.Site != "shop" || len(payload.Particles) != 2 ||
+		payload.Particles[0].BeamId != "a" || payload.Particles[1].BeamId != "c" {
+		t.Errorf("payload = %s", body)
+	}
+
+	if r.Header.Get(webhookNameHeader) != "crm" {
+		t.Errorf("%s = %q", webhookNameHeader, r.Header.Get(webhookNameHeader))
+	}
+
+	timestamp := r.Header.Get(webhookTimestampHeader)
+	if want := webhookSignature("secret", timestamp, body); r.Header.Get(signatureHeader) != want {
+		t.Errorf("%s = %q, want %q", signatureHeader, r.Header.Get(signatureHeader), want)
+	}
+
+	waitForWebhook(t, func() bool {
+		delivered, _ := k.testCounts()
+		return delivered == 2
+	})
+}
+
+func TestWebhookSignature(t *testing.T) {
+	tests := []struct {
+		secret    string
+		timestamp string
+		body      string
+		want      string
+	}{
+		// echo -n '1420070400.{}' | openssl dgst -sha256 -hmac secret
+		{"secret", "1420070400", "{}", "e34149d0016fdd5d488f6a7b3bc4f9fecb2033d9c60a7920cfd569ba1e98796b"},
+	}
+
+	for _, test := range tests {
+		if got := webhookSignature(test.secret, test.timestamp, []byte(test.body)); got != test.want {
+			t.Errorf("webhookSignature(%q, %q, %q) = %s, want %s", test.secret, test.timestamp, test.body, got, test.want)
+		}
+	}
+}
+
+func TestWebhookRetry(t *testing.T) {
+	tests := []struct {
+		name       string
+		statuses   []int
+		attempts   int
+		deadLetter bool
+	}{
+		{"retry on 5xx", []int{http.StatusInternalServerError, http.StatusBadGateway, http.StatusOK}, 3, false},
+		{"retry on 429", []int{http.StatusTooManyRequests, http.StatusOK}, 2, false},
+		{"no retry on 4xx", []int{http.StatusBadRequest}, 1, true},
+		{"dead letter after max attempts", []int{http.StatusServiceUnavailable}, 4, true},
+	}
+
+	for _, test := range tests {
+		receiver := newWebhookReceiver(test.statuses...)
+
+		k, deadLetters := newTestWebhookSink(receiver, 4)
+		k.Start(nil)
+
+		s := &site{Id: "shop"}
+
+		k.Publish(s, &particle{Event: "purchase", BeamId: "a"})
+		k.Publish(s, &particle{Event: "purchase", BeamId: "b"})
+
+		if test.deadLetter {
+			select {
+			case call := <-deadLetters:
+				if call.attempts != test.attempts || len(call.particles) != 2 {
+					t.Errorf("%s: dead lettered %d particles after %d attempts, want 2 after %d", test.name, len(call.particles), call.attempts, test.attempts)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("%s: not dead lettered", test.name)
+			}
+		} else {
+			waitForWebhook(t, func() bool {
+				delivered, _ := k.testCounts()
+				return delivered == 2
+			})
+		}
+
+		// Nothing more should be sent once a batch is delivered or given up.
+		time.Sleep(20 * time.Millisecond)
+
+		if got := receiver.Requests(); got != test.attempts {
+			t.Errorf("%s: %d requests, want %d", test.name, got, test.attempts)
+		}
+
+		if _, failed := k.testCounts(); (failed == 2) != test.deadLetter {
+			t.Errorf("%s: %d failed", test.name, failed)
+		}
+
+		receiver.server.Close()
+	}
+}
+
+func TestWebhookRetryDoesNotBlock(t *testing.T) {
+	failing := newWebhookReceiver(http.StatusServiceUnavailable)
+	defer failing.server.Close()
+
+	k, _ := newTestWebhookSink(failing, 3)
+
+	// Retries wait long enough for the second batch to overtake the first.
+	k.backoff = time.Second
+	k.Start(nil)
+
+	shop := &site{Id: "shop"}
+
+	k.Publish(shop, &particle{Event: "purchase", BeamId: "a"})
+	k.Publish(shop, &particle{Event: "purchase", BeamId: "b"})
+
+	waitForWebhook(t, func() bool { return failing.Requests() == 1 })
+
+	started := time.Now()
+
+	k.Publish(shop, &particle{Event: "purchase", BeamId: "c"})
+	k.Publish(shop, &particle{Event: "purchase", BeamId: "d"})
+
+	waitForWebhook(t, func() bool { return failing.Requests() == 2 })
+
+	if elapsed := time.Since(started); elapsed >= k.backoff {
+		t.Errorf("second batch waited %s for the first one's retry", elapsed)
+	}
+}
+
+func TestWebhookQueueFullDeadLetters(t *testing.T) {
+	k := newWebhookSink(WebhookConfig{
+		Name:      "crm",
+		Events:    []string{"purchase"},
+		BatchSize: 2,
+		QueueSize: 3,
+	})
+
+	s := &site{Id: "shop"}
+
+	// Not started, so the first three fill the queue and the next three
+	// overflow.
+	for i := 0; i < 6; i++ {
+		k.Publish(s, &particle{Event: "purchase", BeamId: strconv.Itoa(i)})
+	}
+
+	k.flushOverflow()
+
+	var batches []*webhookBatch
+
+	for len(k.deadLetters) > 0 {
+		batches = append(batches, <-k.deadLetters)
+	}
+
+	// Dead lettered in batches of batch_size.
+	if len(batches) != 2 || len(batches[0].particles) != 2 || len(batches[1].particles) != 1 ||
+		batches[0].particles[0].BeamId != "3" {
+		t.Fatalf("dead letters = %+v", batches)
+	}
+
+	for _, batch := range batches {
+		if batch.err != errWebhookQueueFull || batch.attempts != 0 {
+			t.Errorf("dead letter = %+v", batch)
+		}
+	}
+
+	if k.failed != 3 || k.dropped != 0 {
+		t.Errorf("failed = %d, dropped = %d, want 3 and 0", k.failed, k.dropped)
+	}
+
+	// Dead lettered once.
+	k.flushOverflow()
+
+	if len(k.deadLetters) != 0 {
+		t.Errorf("%d more dead letters, want 0", len(k.deadLetters))
+	}
+}
+
+func TestWebhookOverflowIsBounded(t *testing.T) {
+	k := newWebhookSink(WebhookConfig{
+		Name:      "crm",
+		Events:    []string{"purchase"},
+		BatchSize: 5,
+		QueueSize: 10,
+	})
+
+	s := &site{Id: "shop"}
+
+	// Nothing is delivering or dead lettering, so everything past the queue
+	// and the overflow is dropped rather than held.
+	for i := 0; i < 100000; i++ {
+		k.Publish(s, &particle{Event: "purchase"})
+	}
+
+	if len(k.queue) != 10 || k.overflowed != 10 || len(k.overflow[s]) != 10 {
+		t.Errorf("queued %d, overflowed %d ( %d held ), want 10 each", len(k.queue), k.overflowed, len(k.overflow[s]))
+	}
+
+	if k.dropped != 100000-20 {
+		t.Errorf("dropped = %d, want %d", k.dropped, 100000-20)
+	}
+
+	// Dead letters that can't be written are dropped too.
+	for i := 0; i < 100; i++ {
+		k.queueDeadLetter(&webhookBatch{site: s, particles: []*particle{{}}}, errWebhookQueueFull)
+	}
+
+	if len(k.deadLetters) != cap(k.deadLetters) || k.failed+k.dropped != 100000-20+100 {
+		t.Errorf("%d dead letters held, failed %d, dropped %d", len(k.deadLetters), k.failed, k.dropped)
+	}
+}
+
+func TestWebhookDeadLettersDoNotBlock(t *testing.T) {
+	receiver := newWebhookReceiver(http.StatusBadRequest)
+	defer receiver.server.Close()
+
+	k, _ := newTestWebhookSink(receiver, 1)
+
+	// A dead letter writer that never finishes, i.e. a stalled database.
+	blocked := make(chan struct{})
+	defer close(blocked)
+
+	k.deadLetter = func(s *site, attempts int, err error, particles []*particle) {
+		<-blocked
+	}
+	k.Start(nil)
+
+	s := &site{Id: "shop"}
+
+	for i := 0; i < 20; i++ {
+		k.Publish(s, &particle{Event: "purchase"})
+	}
+
+	// Every batch is still attempted.
+	waitForWebhook(t, func() bool { return receiver.Requests() == 10 })
+}
+
+func TestWebhookRetryDelay(t *testing.T) {
+	k := &webhookSink{backoff: time.Second}
+
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{4, 8 * time.Second},
+		{20, webhookMaxBackoff},
+	}
+
+	for _, test := range tests {
+		if got := k.retryDelay(test.attempts); got != test.want {
+			t.Errorf("retryDelay(%d) = %s, want %s", test.attempts, got, test.want)
+		}
+	}
+}